@@ -0,0 +1,157 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	a, b := HashID("a"), HashID("b")
+	if Distance(a, a) != (ID{}) {
+		t.Errorf("distance to itself is not zero")
+	}
+	if Distance(a, b) != Distance(b, a) {
+		t.Errorf("distance is not symmetric")
+	}
+	var one ID
+	one[len(one)-1] = 1
+	if got := one.prefixLen(); got != IDBits-1 {
+		t.Errorf("prefix length of 1 is %d, want %d", got, IDBits-1)
+	}
+	if !one.Less(Distance(a, b)) || Distance(a, b).Less(one) {
+		t.Errorf("ordering of distances is wrong")
+	}
+}
+
+func TestRoutingTableUpdate(t *testing.T) {
+	table := NewRoutingTable("self", 2)
+	if _, full := table.Update(Contact{Node: "self"}); full || table.Len() != 0 {
+		t.Fatalf("the node itself was added to its table")
+	}
+
+	// Fill the bucket farthest away, which holds half of all IDs.
+	var far []Contact
+	for i := 0; len(far) < 3; i++ {
+		c := Contact{Node: fmt.Sprint("node", i)}
+		if table.bucket(c.ID()) == 0 {
+			far = append(far, c)
+		}
+	}
+	table.Update(far[0])
+	table.Update(far[1])
+	oldest, full := table.Update(far[2])
+	if !full || oldest != far[0] {
+		t.Fatalf("got (%v, %v) for a full bucket, want (%v, true)", oldest, full, far[0])
+	}
+
+	// Seeing the oldest contact again makes the other one the oldest.
+	table.Update(far[0])
+	if oldest, _ := table.Update(far[2]); oldest != far[1] {
+		t.Errorf("oldest contact is %v, want %v", oldest, far[1])
+	}
+
+	table.Remove(far[1].Node)
+	if _, full := table.Update(far[2]); full || table.Len() != 2 {
+		t.Errorf("contact was not added after removing another one")
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := NewRoutingTable("self", 20)
+	for i := 0; i < 100; i++ {
+		table.Update(Contact{Node: fmt.Sprint("node", i)})
+	}
+	target := HashID("target")
+	closest := table.Closest(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("got %d contacts, want 5", len(closest))
+	}
+	for i := 1; i < len(closest); i++ {
+		if Distance(closest[i].ID(), target).Less(Distance(closest[i-1].ID(), target)) {
+			t.Errorf("contacts are not sorted by distance")
+		}
+	}
+}
+
+// network simulates nodes that only know some of the others.
+type network map[string]*RoutingTable
+
+func newNetwork(n int, known int, k int) network {
+	r := rand.New(rand.NewSource(1))
+	net := make(network)
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprint("node", i)
+		net[nodes[i]] = NewRoutingTable(nodes[i], k)
+	}
+	for _, node := range nodes {
+		// Joining nodes look themselves up, so they know their neighbours
+		// along with some others.
+		neighbours := make([]Contact, n)
+		for i := range nodes {
+			neighbours[i] = Contact{Node: nodes[i]}
+		}
+		sortByDistance(neighbours, HashID(node))
+		for _, c := range neighbours[:known] {
+			net[node].Update(c)
+		}
+		for _, i := range r.Perm(n)[:known] {
+			net[node].Update(Contact{Node: nodes[i]})
+		}
+	}
+	return net
+}
+
+func (net network) query(target ID, failing map[string]bool) QueryFunc {
+	return func(c Contact) ([]Contact, bool, error) {
+		if failing[c.Node] {
+			return nil, false, errors.New("no answer")
+		}
+		return net[c.Node].Closest(target, net[c.Node].k), false, nil
+	}
+}
+
+func TestLookup(t *testing.T) {
+	const k = 8
+	net := newNetwork(300, 10, k)
+	target := HashID("some key")
+
+	var all []Contact
+	for node := range net {
+		// Lookups leave out the node running them.
+		if node != "node0" {
+			all = append(all, Contact{Node: node})
+		}
+	}
+	sortByDistance(all, target)
+
+	// One of the closest nodes is down.
+	failing := map[string]bool{all[1].Node: true}
+	want := append([]Contact{all[0]}, all[2:k+1]...)
+
+	got := net["node0"].Lookup(target, 3, net.query(target, failing))
+	if len(got) != len(want) {
+		t.Fatalf("got %d contacts, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Node != want[i].Node {
+			t.Errorf("contact %d is %s, want %s", i, got[i].Node, want[i].Node)
+		}
+	}
+}
+
+func TestLookupDone(t *testing.T) {
+	net := newNetwork(100, 10, 8)
+	target := HashID("some key")
+
+	queries := 0
+	net["node0"].Lookup(target, 1, func(c Contact) ([]Contact, bool, error) {
+		queries++
+		return nil, true, nil
+	})
+	if queries != 1 {
+		t.Errorf("lookup went on for %d queries after it was done", queries)
+	}
+}
@@ -0,0 +1,69 @@
+// Package dht implements the routing of a Kademlia distributed hash table:
+// node and key IDs in one 256 bit space, the k-buckets of known contacts
+// and the iterative lookup of the nodes closest to an ID. The RPCs it runs
+// on are up to the user, see Lookup.
+package dht
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/bits"
+)
+
+// IDBits is the size of IDs in bits.
+const IDBits = 256
+
+// ID places nodes and keys in the same space, where they are as close as
+// the XOR of their IDs is small.
+type ID [IDBits / 8]byte
+
+// HashID maps s, a node ID or a key, to its ID.
+func HashID(s string) ID {
+	return sha256.Sum256([]byte(s))
+}
+
+// Distance returns the XOR distance between a and b.
+func Distance(a ID, b ID) ID {
+	var d ID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// Less reports whether id is smaller than other, e.g. whether one distance
+// is shorter than another.
+func (id ID) Less(other ID) bool {
+	for i := range id {
+		if id[i] != other[i] {
+			return id[i] < other[i]
+		}
+	}
+	return false
+}
+
+// prefixLen returns the number of leading zero bits of id.
+func (id ID) prefixLen() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDBits
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Contact is a node of the network and where to reach it.
+type Contact struct {
+	// Node is the node ID, HashID places it.
+	Node string
+	Addr string
+}
+
+// ID returns the ID of c.
+func (c Contact) ID() ID {
+	return HashID(c.Node)
+}
@@ -0,0 +1,114 @@
+package dht
+
+// DefaultAlpha is how many nodes a lookup queries at once unless configured
+// otherwise.
+const DefaultAlpha = 3
+
+// QueryFunc asks c for the contacts it knows closest to the target of a
+// lookup, e.g. with a FIND_NODE or FIND_VALUE RPC. Returning done ends the
+// lookup, e.g. once a node returned the value looked for.
+type QueryFunc func(c Contact) (closer []Contact, done bool, err error)
+
+// Lookup finds the k nodes closest to target. Starting from the closest
+// contacts in the table, it queries alpha nodes at a time for closer ones,
+// until the k closest nodes it heard of have all answered or query is
+// done. Nodes that fail to answer are left out. It returns the closest
+// nodes that answered, closest first.
+func (t *RoutingTable) Lookup(target ID, alpha int, query QueryFunc) []Contact {
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+
+	type candidate struct {
+		Contact
+		queried bool
+		failed  bool
+	}
+	var (
+		known      = make(map[string]*candidate)
+		candidates []*candidate
+	)
+	add := func(c Contact) {
+		if _, ok := known[c.Node]; ok || c.ID() == t.self {
+			return
+		}
+		cand := &candidate{Contact: c}
+		known[c.Node] = cand
+		candidates = append(candidates, cand)
+	}
+	// closest returns the k closest candidates that did not fail.
+	closest := func() []*candidate {
+		contacts := make([]Contact, 0, len(candidates))
+		for _, c := range candidates {
+			if !c.failed {
+				contacts = append(contacts, c.Contact)
+			}
+		}
+		sortByDistance(contacts, target)
+		if len(contacts) > t.k {
+			contacts = contacts[:t.k]
+		}
+		result := make([]*candidate, len(contacts))
+		for i, c := range contacts {
+			result[i] = known[c.Node]
+		}
+		return result
+	}
+
+	for _, c := range t.Closest(target, t.k) {
+		add(c)
+	}
+
+	type answer struct {
+		cand   *candidate
+		closer []Contact
+		done   bool
+		err    error
+	}
+	for {
+		var batch []*candidate
+		for _, c := range closest() {
+			if !c.queried {
+				batch = append(batch, c)
+				if len(batch) == alpha {
+					break
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		answers := make(chan answer, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *candidate) {
+				closer, done, err := query(c.Contact)
+				answers <- answer{c, closer, done, err}
+			}(c)
+		}
+		done := false
+		for range batch {
+			a := <-answers
+			if a.err != nil {
+				a.cand.failed = true
+				continue
+			}
+			for _, c := range a.closer {
+				add(c)
+			}
+			done = done || a.done
+		}
+		if done {
+			break
+		}
+	}
+
+	var result []Contact
+	for _, c := range closest() {
+		if c.queried {
+			result = append(result, c.Contact)
+		}
+	}
+	return result
+}
@@ -0,0 +1,119 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultK is how many contacts a bucket holds and a lookup returns unless
+// configured otherwise.
+const DefaultK = 20
+
+// RoutingTable keeps the contacts of a node in k-buckets: bucket i holds up
+// to k contacts whose distance to the node has i leading zero bits, so the
+// node knows many contacts close to it and a few far away. Contacts are
+// kept in the order they were last seen, least recent first.
+type RoutingTable struct {
+	self ID
+	k    int
+
+	mu      sync.Mutex
+	buckets [IDBits][]Contact
+}
+
+// NewRoutingTable returns an empty routing table of the node self with
+// buckets of k contacts, or DefaultK if k is not positive.
+func NewRoutingTable(self string, k int) *RoutingTable {
+	if k <= 0 {
+		k = DefaultK
+	}
+	return &RoutingTable{self: HashID(self), k: k}
+}
+
+// bucket returns the index of the bucket of id, or -1 for the node itself.
+func (t *RoutingTable) bucket(id ID) int {
+	i := Distance(t.self, id).prefixLen()
+	if i == IDBits {
+		return -1
+	}
+	return i
+}
+
+// Update records that c was seen. Known contacts move to the end of their
+// bucket. If the bucket of a new contact is full, c is left out and the
+// least recently seen contact of the bucket is returned along with true:
+// Kademlia keeps it unless it fails to respond, in which case the caller
+// removes it and updates c again.
+func (t *RoutingTable) Update(c Contact) (Contact, bool) {
+	i := t.bucket(c.ID())
+	if i < 0 {
+		return Contact{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, known := range b {
+		if known.Node == c.Node {
+			copy(b[j:], b[j+1:])
+			b[len(b)-1] = c
+			return Contact{}, false
+		}
+	}
+	if len(b) >= t.k {
+		return b[0], true
+	}
+	t.buckets[i] = append(b, c)
+	return Contact{}, false
+}
+
+// Remove forgets the contact of node.
+func (t *RoutingTable) Remove(node string) {
+	i := t.bucket(HashID(node))
+	if i < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buckets[i]
+	for j, known := range b {
+		if known.Node == node {
+			t.buckets[i] = append(b[:j], b[j+1:]...)
+			return
+		}
+	}
+}
+
+// Len returns the number of contacts in the table.
+func (t *RoutingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+// Closest returns the n contacts closest to target, closest first.
+func (t *RoutingTable) Closest(target ID, n int) []Contact {
+	t.mu.Lock()
+	var contacts []Contact
+	for _, b := range t.buckets {
+		contacts = append(contacts, b...)
+	}
+	t.mu.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func sortByDistance(contacts []Contact, target ID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return Distance(contacts[i].ID(), target).Less(Distance(contacts[j].ID(), target))
+	})
+}
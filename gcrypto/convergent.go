@@ -0,0 +1,51 @@
+package gcrypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Convergent encryption seals data with a key derived from the data itself,
+// so equal plaintexts yield equal ciphertexts and can be deduplicated by
+// whoever stores them without being able to read them. The key is derived
+// with a secret as well, which keeps anyone without it from confirming
+// guesses of the plaintext, but equal data sealed with the same secret is
+// still recognisable as such.
+
+// ConvergentOverhead is how much longer SealConvergent makes its input.
+const ConvergentOverhead = 16
+
+// ConvergentKey derives the key SealConvergent seals data with from secret
+// and the SHA-256 digest of data.
+func ConvergentKey(secret []byte, digest []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("gdss convergent key"))
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+// SealConvergent encrypts and authenticates data with key, see
+// ConvergentKey. Every key only ever seals the data it was derived from,
+// which makes the fixed nonce safe.
+func SealConvergent(key []byte, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(make([]byte, 0, len(data)+aead.Overhead()), nonce, data, nil), nil
+}
+
+// OpenConvergent decrypts what SealConvergent sealed with key.
+func OpenConvergent(key []byte, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	data, err := aead.Open(make([]byte, 0, len(sealed)), nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return data, nil
+}
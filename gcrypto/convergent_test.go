@@ -0,0 +1,38 @@
+package gcrypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvergent(t *testing.T) {
+	secret := NewEncryptionKey()
+	data := []byte("some chunk of a file")
+	digest := sha256.Sum256(data)
+
+	key := ConvergentKey(secret, digest[:])
+	a, err := SealConvergent(key, data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data)+ConvergentOverhead, len(a))
+
+	// Equal data sealed with the same secret can be deduplicated.
+	b, err := SealConvergent(ConvergentKey(secret, digest[:]), data)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(a, b))
+
+	// Other secrets make it unrecognisable.
+	c, err := SealConvergent(ConvergentKey(NewEncryptionKey(), digest[:]), data)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(a, c))
+
+	opened, err := OpenConvergent(key, a)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, opened))
+
+	a[0] ^= 1
+	_, err = OpenConvergent(key, a)
+	assert.Equal(t, ErrAuthentication, err)
+}
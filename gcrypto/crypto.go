@@ -1,11 +1,17 @@
 package gcrypto
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 )
 
@@ -15,7 +21,22 @@ func GenerateID() string {
 	return hex.EncodeToString(buf)
 }
 
+// HashKey maps key to the hex encoded SHA-256 digest files are stored and
+// replicated under.
 func HashKey(key string) string {
+	return HashKeyWith(sha256.New, key)
+}
+
+// HashKeyWith is like HashKey, but hashes with h.
+func HashKeyWith(h func() hash.Hash, key string) string {
+	hash := h()
+	hash.Write([]byte(key))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// LegacyHashKey is the MD5 based HashKey of earlier releases, which is
+// needed to find the files they replicated when migrating storage.
+func LegacyHashKey(key string) string {
 	hash := md5.Sum([]byte(key))
 	return hex.EncodeToString(hash[:])
 }
@@ -26,64 +47,238 @@ func NewEncryptionKey() []byte {
 	return keyBuf
 }
 
-func CopyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
-	var (
-		buf = make([]byte, 32*1024)
-		nw  = blockSize
-	)
-	for {
-		n, err := src.Read(buf)
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw += nn
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
+// Encrypted streams are an envelope (see Envelope) followed by a sequence of
+// AES-GCM sealed chunks:
+//
+//	header: magic[4] | version[1] | nonce prefix[7] | chunk size[4]
+//	chunk:  ciphertext[<= chunk size] | tag[16]
+//
+// Every stream is encrypted with its own random data key, which the envelope
+// carries wrapped for each recipient, typically the node's master key.
+//
+// The nonce of chunk i is the nonce prefix, i as a big endian uint32 and a
+// final flag byte that is 1 for the last chunk only. Every chunk is
+// authenticated together with the header, so reordering, dropping or
+// appending chunks, flipping bits and truncating the stream are all
+// detected on decryption.
+const (
+	formatVersion    = 3
+	headerSize       = 16
+	noncePrefixSize  = 7
+	DefaultChunkSize = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+)
+
+var formatMagic = [4]byte{'G', 'D', 'S', 'E'}
+
+var (
+	// ErrInvalidHeader is returned when a stream does not start with a
+	// valid header.
+	ErrInvalidHeader = errors.New("gcrypto: invalid stream header")
+	// ErrUnsupportedVersion is returned for streams of an unknown format
+	// version.
+	ErrUnsupportedVersion = errors.New("gcrypto: unsupported stream version")
+	// ErrAuthentication is returned when a chunk fails authentication, which
+	// means the stream was tampered with, truncated or encrypted with
+	// another key.
+	ErrAuthentication = errors.New("gcrypto: message authentication failed")
+	// ErrUnknownKey is returned when none of the stanzas of a stream can be
+	// unwrapped with the keys at hand.
+	ErrUnknownKey = errors.New("gcrypto: unknown encryption key")
+)
+
+// EncryptedSize returns the size of the stream CopyEncryptTo produces for
+// size bytes of plaintext and the given recipients.
+func EncryptedSize(size int64, recipients ...Recipient) int64 {
+	chunks := (size + DefaultChunkSize - 1) / DefaultChunkSize
+	if chunks == 0 {
+		chunks = 1
 	}
-	return nw, nil
+	return envelopeSize(recipients) + size + chunks*16
 }
 
-func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+type streamHeader struct {
+	noncePrefix [noncePrefixSize]byte
+	chunkSize   uint32
+}
+
+func (h *streamHeader) marshal() []byte {
+	buf := make([]byte, headerSize)
+	copy(buf[0:4], formatMagic[:])
+	buf[4] = formatVersion
+	copy(buf[5:12], h.noncePrefix[:])
+	binary.BigEndian.PutUint32(buf[12:16], h.chunkSize)
+	return buf
+}
+
+func readStreamHeader(r io.Reader) (*streamHeader, error) {
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+	if [4]byte(buf[0:4]) != formatMagic {
+		return nil, ErrInvalidHeader
+	}
+	if buf[4] != formatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, buf[4])
+	}
+
+	h := &streamHeader{chunkSize: binary.BigEndian.Uint32(buf[12:16])}
+	copy(h.noncePrefix[:], buf[5:12])
+	if h.chunkSize == 0 || h.chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("%w: chunk size %d", ErrInvalidHeader, h.chunkSize)
+	}
+	return h, nil
+}
+
+func (h *streamHeader) nonce(counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.noncePrefix[:])
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readChunk fills buf from r and reports whether it is the last chunk of
+// the stream.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
 	}
+	return n, false, nil
+}
+
+// CopyDecrypt reads an encrypted stream from src and writes the plaintext to
+// dst, one authenticated chunk at a time. Since the stream is not buffered
+// as a whole, dst may already hold the plaintext of earlier chunks when
+// authentication of a later one fails. src is read until EOF.
+func CopyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return CopyDecryptKeyRing(StaticKey(key), src, dst)
+}
+
+// CopyDecryptKeyRing is like CopyDecrypt, but unwraps the data key with any
+// of the master keys held by ring.
+func CopyDecryptKeyRing(ring KeyRing, src io.Reader, dst io.Writer) (int, error) {
+	return CopyDecryptWith(src, dst, KeyRingUnwrapper{ring})
+}
 
-	// Read the IV from the given io.Reader which, in our case should be the
-	// the block.BlockSize() bytes we read.
-	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+// CopyDecryptWith is like CopyDecrypt, but unwraps the data key with the
+// first of unwrappers a stanza is addressed to.
+func CopyDecryptWith(src io.Reader, dst io.Writer, unwrappers ...Unwrapper) (int, error) {
+	r := bufio.NewReader(src)
+	e, err := ReadEnvelope(r)
+	if err != nil {
+		return 0, err
+	}
+	dataKey, err := e.DataKey(unwrappers...)
+	if err != nil {
+		return 0, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
 		return 0, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return CopyStream(stream, block.BlockSize(), src, dst)
+	var (
+		h   = e.header
+		aad = h.marshal()
+		buf = make([]byte, int(h.chunkSize)+aead.Overhead())
+		nw  int
+	)
+	for counter := uint32(0); ; counter++ {
+		n, final, err := readChunk(r, buf)
+		if err != nil {
+			return nw, err
+		}
+		if n < aead.Overhead() {
+			return nw, ErrAuthentication
+		}
+
+		plain, err := aead.Open(buf[:0], h.nonce(counter, final), buf[:n], aad)
+		if err != nil {
+			return nw, ErrAuthentication
+		}
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+		if final {
+			return nw, nil
+		}
+		if counter == ^uint32(0) {
+			return nw, errors.New("gcrypto: stream too long")
+		}
+	}
 }
 
+// CopyEncrypt reads plaintext from src until EOF and writes it to dst as an
+// encrypted stream whose data key is wrapped with the master key key. It
+// returns the number of bytes written to dst.
 func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	return CopyEncryptTo(src, dst, KeyRecipient(key))
+}
+
+// CopyEncryptTo is like CopyEncrypt, but wraps the data key for every one of
+// recipients.
+func CopyEncryptTo(src io.Reader, dst io.Writer, recipients ...Recipient) (int, error) {
+	dataKey := NewEncryptionKey()
+	aead, err := newGCM(dataKey)
 	if err != nil {
 		return 0, err
 	}
-
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	e, err := newEnvelope(dataKey, recipients)
+	if err != nil {
 		return 0, err
 	}
 
-	// prepend the IV to the file.
-	if _, err := dst.Write(iv); err != nil {
-		return 0, err
+	nw, err := dst.Write(e.Marshal())
+	if err != nil {
+		return nw, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return CopyStream(stream, block.BlockSize(), src, dst)
+	var (
+		h   = e.header
+		aad = h.marshal()
+		r   = bufio.NewReader(src)
+		buf = make([]byte, DefaultChunkSize, DefaultChunkSize+aead.Overhead())
+	)
+	for counter := uint32(0); ; counter++ {
+		n, final, err := readChunk(r, buf[:DefaultChunkSize])
+		if err != nil {
+			return nw, err
+		}
+
+		sealed := aead.Seal(buf[:0], h.nonce(counter, final), buf[:n], aad)
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+		if final {
+			return nw, nil
+		}
+		if counter == ^uint32(0) {
+			return nw, errors.New("gcrypto: stream too long")
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package gcrypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyEncryptDecrypt(t *testing.T) {
+	key := NewEncryptionKey()
+
+	for _, size := range []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 3 * DefaultChunkSize} {
+		plain := bytes.Repeat([]byte{'x'}, size)
+
+		enc := new(bytes.Buffer)
+		n, err := CopyEncrypt(key, bytes.NewReader(plain), enc)
+		assert.Nil(t, err)
+		assert.Equal(t, enc.Len(), n)
+		assert.Equal(t, EncryptedSize(int64(size), KeyRecipient(key)), int64(n))
+
+		dec := new(bytes.Buffer)
+		n, err = CopyDecrypt(key, enc, dec)
+		assert.Nil(t, err)
+		assert.Equal(t, size, n)
+		assert.True(t, bytes.Equal(plain, dec.Bytes()))
+	}
+}
+
+func TestCopyDecryptDetectsTampering(t *testing.T) {
+	key := NewEncryptionKey()
+	plain := bytes.Repeat([]byte("gdss"), DefaultChunkSize)
+
+	enc := new(bytes.Buffer)
+	_, err := CopyEncrypt(key, bytes.NewReader(plain), enc)
+	assert.Nil(t, err)
+	ciphertext := enc.Bytes()
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[len(flipped)/2] ^= 1
+	_, err = CopyDecrypt(key, bytes.NewReader(flipped), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrAuthentication)
+
+	// Dropping the final chunk leaves a stream that ends on a chunk boundary.
+	truncated := ciphertext[:envelopeSize([]Recipient{KeyRecipient(key)})+2*(DefaultChunkSize+16)]
+	_, err = CopyDecrypt(key, bytes.NewReader(truncated), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrAuthentication)
+
+	_, err = CopyDecrypt(NewEncryptionKey(), bytes.NewReader(ciphertext), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = CopyDecrypt(key, bytes.NewReader(ciphertext[:4]), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
+
+func TestRewrap(t *testing.T) {
+	oldKey, newKey := NewEncryptionKey(), NewEncryptionKey()
+	plain := bytes.Repeat([]byte("gdss"), DefaultChunkSize)
+
+	enc := new(bytes.Buffer)
+	_, err := CopyEncrypt(oldKey, bytes.NewReader(plain), enc)
+	assert.Nil(t, err)
+	body := enc.Bytes()[envelopeSize([]Recipient{KeyRecipient(oldKey)}):]
+
+	rewrapped := new(bytes.Buffer)
+	_, err = Rewrap(bytes.NewReader(enc.Bytes()), rewrapped, []Unwrapper{KeyRingUnwrapper{StaticKey(oldKey)}}, KeyRecipient(newKey))
+	assert.Nil(t, err)
+
+	// Only the envelope changed, the encrypted body is the same.
+	assert.True(t, bytes.HasSuffix(rewrapped.Bytes(), body))
+
+	_, err = CopyDecrypt(oldKey, bytes.NewReader(rewrapped.Bytes()), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	dec := new(bytes.Buffer)
+	_, err = CopyDecrypt(newKey, rewrapped, dec)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(plain, dec.Bytes()))
+}
@@ -0,0 +1,244 @@
+package gcrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stanza types.
+const (
+	// StanzaKey wraps the data key with a symmetric master key.
+	StanzaKey = 0x1
+)
+
+const (
+	dataKeySize   = 32
+	keyStanzaSize = len(KeyID{}) + 12 + dataKeySize + 16
+	maxStanzaSize = 1<<16 - 1
+)
+
+// errNoMatch is returned by an Unwrapper for stanzas not addressed to it.
+var errNoMatch = errors.New("gcrypto: stanza does not match")
+
+// Stanza holds the data key of a stream wrapped for one recipient.
+type Stanza struct {
+	Type uint8
+	Body []byte
+}
+
+// Recipient wraps a stream's data key for one party able to decrypt it.
+// header is the fixed stream header; binding it into the wrap ties the
+// stanza to one stream.
+type Recipient interface {
+	Wrap(dataKey, header []byte) (Stanza, error)
+	// StanzaSize is the length of the stanza bodies Wrap returns.
+	StanzaSize() int
+}
+
+// Unwrapper recovers a stream's data key from a stanza addressed to it.
+type Unwrapper interface {
+	Unwrap(s Stanza, header []byte) ([]byte, error)
+}
+
+// KeyRecipient wraps data keys with a symmetric master key.
+type KeyRecipient []byte
+
+func (k KeyRecipient) Wrap(dataKey, header []byte) (Stanza, error) {
+	aead, err := newGCM(k)
+	if err != nil {
+		return Stanza{}, err
+	}
+	id := KeyIDOf(k)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return Stanza{}, err
+	}
+
+	body := make([]byte, 0, keyStanzaSize)
+	body = append(body, id[:]...)
+	body = append(body, nonce...)
+	body = aead.Seal(body, nonce, dataKey, header)
+	return Stanza{Type: StanzaKey, Body: body}, nil
+}
+
+func (k KeyRecipient) StanzaSize() int {
+	return keyStanzaSize
+}
+
+// KeyRingUnwrapper unwraps key stanzas with any key held by a KeyRing.
+type KeyRingUnwrapper struct {
+	KeyRing
+}
+
+func (u KeyRingUnwrapper) Unwrap(s Stanza, header []byte) ([]byte, error) {
+	if s.Type != StanzaKey || len(s.Body) != keyStanzaSize {
+		return nil, errNoMatch
+	}
+	var id KeyID
+	copy(id[:], s.Body)
+	key, ok := u.Key(id)
+	if !ok {
+		return nil, errNoMatch
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := s.Body[len(id) : len(id)+aead.NonceSize()]
+	dataKey, err := aead.Open(nil, nonce, s.Body[len(id)+aead.NonceSize():], header)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
+
+// Envelope is everything in front of the encrypted chunks of a stream: the
+// fixed header and the stanzas holding the wrapped data key.
+//
+//	envelope: header[16] | stanza count[1] | stanza...
+//	stanza:   type[1] | length[2] | body[length]
+//
+// Only the fixed header is authenticated with the chunks, so the stanzas can
+// be rewritten (see Rewrap) without touching the encrypted body.
+type Envelope struct {
+	header  streamHeader
+	Stanzas []Stanza
+}
+
+func newEnvelope(dataKey []byte, recipients []Recipient) (*Envelope, error) {
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return nil, fmt.Errorf("gcrypto: need between 1 and 255 recipients, got %d", len(recipients))
+	}
+
+	e := &Envelope{header: streamHeader{chunkSize: DefaultChunkSize}}
+	if _, err := io.ReadFull(rand.Reader, e.header.noncePrefix[:]); err != nil {
+		return nil, err
+	}
+	if err := e.wrap(dataKey, recipients); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Envelope) wrap(dataKey []byte, recipients []Recipient) error {
+	aad := e.header.marshal()
+	stanzas := make([]Stanza, 0, len(recipients))
+	for _, r := range recipients {
+		s, err := r.Wrap(dataKey, aad)
+		if err != nil {
+			return err
+		}
+		stanzas = append(stanzas, s)
+	}
+	e.Stanzas = stanzas
+	return nil
+}
+
+// DataKey unwraps the data key with the first stanza one of unwrappers can
+// open.
+func (e *Envelope) DataKey(unwrappers ...Unwrapper) ([]byte, error) {
+	aad := e.header.marshal()
+	for _, s := range e.Stanzas {
+		for _, u := range unwrappers {
+			key, err := u.Unwrap(s, aad)
+			if err == errNoMatch {
+				continue
+			}
+			return key, err
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Rewrap replaces the stanzas with ones for recipients, keeping the data key
+// and therefore the encrypted body as they are.
+func (e *Envelope) Rewrap(unwrappers []Unwrapper, recipients ...Recipient) error {
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return fmt.Errorf("gcrypto: need between 1 and 255 recipients, got %d", len(recipients))
+	}
+	dataKey, err := e.DataKey(unwrappers...)
+	if err != nil {
+		return err
+	}
+	return e.wrap(dataKey, recipients)
+}
+
+// SameStream reports whether e and o are envelopes of the same encrypted
+// body, which is what a rewrapped envelope must be.
+func (e *Envelope) SameStream(o *Envelope) bool {
+	return e.header == o.header
+}
+
+// Marshal encodes the envelope as it appears at the start of the stream.
+func (e *Envelope) Marshal() []byte {
+	buf := bytes.NewBuffer(e.header.marshal())
+	buf.WriteByte(uint8(len(e.Stanzas)))
+	for _, s := range e.Stanzas {
+		buf.WriteByte(s.Type)
+		binary.Write(buf, binary.BigEndian, uint16(len(s.Body)))
+		buf.Write(s.Body)
+	}
+	return buf.Bytes()
+}
+
+// ReadEnvelope reads the envelope at the start of an encrypted stream,
+// leaving r positioned at the first chunk.
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	h, err := readStreamHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var count [1]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+	}
+
+	e := &Envelope{header: *h, Stanzas: make([]Stanza, count[0])}
+	for i := range e.Stanzas {
+		var hdr [3]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidHeader, err)
+		}
+		e.Stanzas[i] = Stanza{Type: hdr[0], Body: body}
+	}
+	return e, nil
+}
+
+// envelopeSize returns the encoded size of an envelope for recipients.
+func envelopeSize(recipients []Recipient) int64 {
+	size := int64(headerSize + 1)
+	for _, r := range recipients {
+		size += int64(3 + r.StanzaSize())
+	}
+	return size
+}
+
+// Rewrap copies the encrypted stream src to dst, replacing its stanzas with
+// ones for recipients. The encrypted body is copied as is. It returns the
+// number of bytes written to dst.
+func Rewrap(src io.Reader, dst io.Writer, unwrappers []Unwrapper, recipients ...Recipient) (int64, error) {
+	e, err := ReadEnvelope(src)
+	if err != nil {
+		return 0, err
+	}
+	if err := e.Rewrap(unwrappers, recipients...); err != nil {
+		return 0, err
+	}
+
+	n, err := dst.Write(e.Marshal())
+	if err != nil {
+		return int64(n), err
+	}
+	nn, err := io.Copy(dst, src)
+	return int64(n) + nn, err
+}
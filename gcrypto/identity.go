@@ -0,0 +1,110 @@
+package gcrypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const identityPEMType = "PRIVATE KEY"
+
+// Identity is the long-lived ed25519 keypair of a node. The node ID is
+// derived from the public key, so a node can only claim an ID whose key it
+// holds.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewIdentity generates a fresh node identity.
+func NewIdentity() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored at path, generating and
+// persisting a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createIdentity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != identityPEMType {
+		return nil, fmt.Errorf("%s: no identity key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: identity key is not ed25519", path)
+	}
+	return &Identity{
+		PublicKey:  priv.Public().(ed25519.PublicKey),
+		PrivateKey: priv,
+	}, nil
+}
+
+func createIdentity(path string) (*Identity, error) {
+	id, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(id.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// ID returns the node ID belonging to this identity.
+func (i *Identity) ID() string {
+	return NodeID(i.PublicKey)
+}
+
+// Sign signs msg with the identity's private key.
+func (i *Identity) Sign(msg []byte) []byte {
+	return ed25519.Sign(i.PrivateKey, msg)
+}
+
+// NodeID derives the node ID from a public key.
+func NodeID(pub ed25519.PublicKey) string {
+	hash := sha256.Sum256(pub)
+	return hex.EncodeToString(hash[:])
+}
+
+// ParsePublicKey decodes a hex encoded ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
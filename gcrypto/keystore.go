@@ -0,0 +1,278 @@
+package gcrypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyID identifies an encryption key without revealing it.
+type KeyID [8]byte
+
+// KeyIDOf returns the id of key.
+func KeyIDOf(key []byte) KeyID {
+	hash := sha256.Sum256(append([]byte("gdss-key-id"), key...))
+	var id KeyID
+	copy(id[:], hash[:])
+	return id
+}
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// KeyRing looks up encryption keys by id.
+type KeyRing interface {
+	Key(id KeyID) ([]byte, bool)
+}
+
+// ActiveKeyRing is a KeyRing that also knows the key new data should be
+// encrypted with, which may change while it is in use.
+type ActiveKeyRing interface {
+	KeyRing
+	ActiveKey() []byte
+}
+
+// StaticKey is a KeyRing holding a single key.
+type StaticKey []byte
+
+func (k StaticKey) Key(id KeyID) ([]byte, bool) {
+	if KeyIDOf(k) != id {
+		return nil, false
+	}
+	return k, true
+}
+
+// ActiveKey implements ActiveKeyRing, the key being the only one.
+func (k StaticKey) ActiveKey() []byte {
+	return k
+}
+
+const keyStoreVersion = 1
+
+// ErrWrongPassphrase is returned when a key store cannot be unlocked.
+var ErrWrongPassphrase = errors.New("gcrypto: wrong key store passphrase")
+
+// Argon2id parameters for new key stores, following the second
+// recommendation of RFC 9106.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+type keyStoreFile struct {
+	Version int          `json:"version"`
+	KDF     kdfParams    `json:"kdf"`
+	Active  string       `json:"active"`
+	Keys    []wrappedKey `json:"keys"`
+}
+
+type kdfParams struct {
+	Name    string `json:"name"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+type wrappedKey struct {
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+}
+
+// KeyStore holds a node's master keys in a file, each one sealed with a key
+// derived from a passphrase. One key is active and used for new data, older
+// ones stay available for decrypting what was written before a rotation.
+type KeyStore struct {
+	path string
+	kek  []byte
+
+	lock   sync.RWMutex
+	file   keyStoreFile
+	keys   map[KeyID][]byte
+	active KeyID
+}
+
+// OpenKeyStore unlocks the key store at path with passphrase. If there is no
+// key store yet, one holding a fresh master key is created.
+func OpenKeyStore(path string, passphrase []byte) (*KeyStore, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKeyStore(path, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeyStore{
+		path: path,
+		keys: make(map[KeyID][]byte),
+	}
+	if err := json.Unmarshal(b, &ks.file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if ks.file.Version != keyStoreVersion {
+		return nil, fmt.Errorf("%s: unsupported key store version %d", path, ks.file.Version)
+	}
+	if ks.file.KDF.Name != "argon2id" {
+		return nil, fmt.Errorf("%s: unsupported kdf %q", path, ks.file.KDF.Name)
+	}
+	ks.kek = ks.file.KDF.derive(passphrase)
+
+	for _, wk := range ks.file.Keys {
+		key, err := ks.unwrap(wk)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[KeyIDOf(key)] = key
+		if wk.ID == ks.file.Active {
+			ks.active = KeyIDOf(key)
+		}
+	}
+	if _, ok := ks.keys[ks.active]; !ok {
+		return nil, fmt.Errorf("%s: active key %s not found", path, ks.file.Active)
+	}
+	return ks, nil
+}
+
+func createKeyStore(path string, passphrase []byte) (*KeyStore, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	kdf := kdfParams{
+		Name:    "argon2id",
+		Salt:    salt,
+		Time:    argonTime,
+		Memory:  argonMemory,
+		Threads: argonThreads,
+	}
+	ks := &KeyStore{
+		path: path,
+		kek:  kdf.derive(passphrase),
+		file: keyStoreFile{Version: keyStoreVersion, KDF: kdf},
+		keys: make(map[KeyID][]byte),
+	}
+	if _, err := ks.Rotate(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (p kdfParams) derive(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+// ActiveKey returns the key new data should be encrypted with. It
+// implements ActiveKeyRing.
+func (ks *KeyStore) ActiveKey() []byte {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.keys[ks.active]
+}
+
+// ActiveKeyID returns the id of the active key.
+func (ks *KeyStore) ActiveKeyID() KeyID {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	return ks.active
+}
+
+// Key implements KeyRing, returning active as well as rotated-out keys.
+func (ks *KeyStore) Key(id KeyID) ([]byte, bool) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+	key, ok := ks.keys[id]
+	return key, ok
+}
+
+// Rotate generates a new master key, makes it the active one and persists
+// the key store. Previous keys are kept for decryption.
+func (ks *KeyStore) Rotate() (KeyID, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	key := NewEncryptionKey()
+	id := KeyIDOf(key)
+
+	wk, err := ks.wrap(id, key)
+	if err != nil {
+		return KeyID{}, err
+	}
+
+	file := ks.file
+	file.Keys = append(append([]wrappedKey{}, ks.file.Keys...), wk)
+	file.Active = id.String()
+	if err := writeKeyStoreFile(ks.path, file); err != nil {
+		return KeyID{}, err
+	}
+
+	ks.file = file
+	ks.keys[id] = key
+	ks.active = id
+	return id, nil
+}
+
+func (ks *KeyStore) wrap(id KeyID, key []byte) (wrappedKey, error) {
+	aead, err := newGCM(ks.kek)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{
+		ID:         id.String(),
+		Created:    time.Now().UTC(),
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, key, []byte(id.String())),
+	}, nil
+}
+
+func (ks *KeyStore) unwrap(wk wrappedKey) ([]byte, error) {
+	aead, err := newGCM(ks.kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s: invalid key %s", ks.path, wk.ID)
+	}
+	key, err := aead.Open(nil, wk.Nonce, wk.Ciphertext, []byte(wk.ID))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// writeKeyStoreFile replaces the key store at path without ever leaving a
+// partially written file behind.
+func writeKeyStoreFile(path string, file keyStoreFile) error {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
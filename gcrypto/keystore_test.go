@@ -0,0 +1,43 @@
+package gcrypto
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyStoreRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	passphrase := []byte("correct horse battery staple")
+
+	ks, err := OpenKeyStore(path, passphrase)
+	assert.Nil(t, err)
+	oldKey := ks.ActiveKey()
+
+	enc := new(bytes.Buffer)
+	_, err = CopyEncrypt(oldKey, bytes.NewReader([]byte("before rotation")), enc)
+	assert.Nil(t, err)
+
+	newID, err := ks.Rotate()
+	assert.Nil(t, err)
+	assert.NotEqual(t, KeyIDOf(oldKey), newID)
+
+	// Users of the key store see the rotation right away.
+	var ring ActiveKeyRing = ks
+	assert.Equal(t, newID, KeyIDOf(ring.ActiveKey()))
+
+	// Reopening yields the rotated key as active and still knows the old one.
+	ks, err = OpenKeyStore(path, passphrase)
+	assert.Nil(t, err)
+	assert.Equal(t, newID, ks.ActiveKeyID())
+
+	dec := new(bytes.Buffer)
+	_, err = CopyDecryptKeyRing(ks, enc, dec)
+	assert.Nil(t, err)
+	assert.Equal(t, "before rotation", dec.String())
+
+	_, err = OpenKeyStore(path, []byte("wrong"))
+	assert.ErrorIs(t, err, ErrWrongPassphrase)
+}
@@ -0,0 +1,185 @@
+package gcrypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// StanzaX25519 wraps the data key for an X25519 public key.
+const StanzaX25519 = 0x2
+
+const (
+	x25519KeySize    = 32
+	x25519StanzaSize = x25519KeySize + dataKeySize + 16
+	x25519Info       = "gdss-x25519"
+)
+
+// X25519Recipient lets the holder of the matching X25519Identity decrypt a
+// stream. Every stanza uses a fresh ephemeral key, so stanzas do not reveal
+// who they are addressed to.
+type X25519Recipient struct {
+	pub *ecdh.PublicKey
+}
+
+// ParseX25519Recipient decodes a hex encoded X25519 public key.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Recipient{pub: pub}, nil
+}
+
+// String returns the hex encoded public key.
+func (r *X25519Recipient) String() string {
+	return hex.EncodeToString(r.pub.Bytes())
+}
+
+func (r *X25519Recipient) Wrap(dataKey, header []byte) (Stanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Stanza{}, err
+	}
+	shared, err := eph.ECDH(r.pub)
+	if err != nil {
+		return Stanza{}, err
+	}
+	wrapKey, err := x25519WrapKey(shared, eph.PublicKey().Bytes(), r.pub.Bytes())
+	if err != nil {
+		return Stanza{}, err
+	}
+	aead, err := newGCM(wrapKey)
+	if err != nil {
+		return Stanza{}, err
+	}
+
+	// The wrap key is unique to this stanza, so a fixed nonce is safe.
+	body := append([]byte{}, eph.PublicKey().Bytes()...)
+	body = aead.Seal(body, make([]byte, aead.NonceSize()), dataKey, header)
+	return Stanza{Type: StanzaX25519, Body: body}, nil
+}
+
+func (r *X25519Recipient) StanzaSize() int {
+	return x25519StanzaSize
+}
+
+// X25519Identity is the private half of an X25519Recipient.
+type X25519Identity struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewX25519Identity generates a fresh X25519 identity.
+func NewX25519Identity() (*X25519Identity, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{priv: priv}, nil
+}
+
+// LoadOrCreateX25519Identity reads the X25519 identity stored at path,
+// generating and persisting a new one if the file does not exist yet.
+func LoadOrCreateX25519Identity(path string) (*X25519Identity, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createX25519Identity(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != identityPEMType {
+		return nil, fmt.Errorf("%s: no identity key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdh.PrivateKey)
+	if !ok || priv.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s: identity key is not x25519", path)
+	}
+	return &X25519Identity{priv: priv}, nil
+}
+
+func createX25519Identity(path string) (*X25519Identity, error) {
+	id, err := NewX25519Identity()
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(id.priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	b := pem.EncodeToMemory(&pem.Block{Type: identityPEMType, Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Recipient returns the recipient streams for this identity are encrypted
+// to.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{pub: i.priv.PublicKey()}
+}
+
+func (i *X25519Identity) Unwrap(s Stanza, header []byte) ([]byte, error) {
+	if s.Type != StanzaX25519 || len(s.Body) != x25519StanzaSize {
+		return nil, errNoMatch
+	}
+
+	eph, err := ecdh.X25519().NewPublicKey(s.Body[:x25519KeySize])
+	if err != nil {
+		return nil, errNoMatch
+	}
+	shared, err := i.priv.ECDH(eph)
+	if err != nil {
+		return nil, errNoMatch
+	}
+	wrapKey, err := x25519WrapKey(shared, eph.Bytes(), i.priv.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), s.Body[x25519KeySize:], header)
+	if err != nil {
+		// Stanzas are anonymous, failing to open one just means it is
+		// addressed to somebody else.
+		return nil, errNoMatch
+	}
+	return dataKey, nil
+}
+
+func x25519WrapKey(shared, ephPub, recipientPub []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephPub...), recipientPub...)
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,42 @@
+package gcrypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestX25519Recipients(t *testing.T) {
+	master := NewEncryptionKey()
+	alice, err := NewX25519Identity()
+	assert.Nil(t, err)
+	bob, err := NewX25519Identity()
+	assert.Nil(t, err)
+
+	enc := new(bytes.Buffer)
+	n, err := CopyEncryptTo(bytes.NewReader([]byte("shared secret")), enc, KeyRecipient(master), alice.Recipient(), bob.Recipient())
+	assert.Nil(t, err)
+	assert.Equal(t, EncryptedSize(13, KeyRecipient(master), alice.Recipient(), bob.Recipient()), int64(n))
+
+	for _, id := range []*X25519Identity{alice, bob} {
+		dec := new(bytes.Buffer)
+		_, err := CopyDecryptWith(bytes.NewReader(enc.Bytes()), dec, id)
+		assert.Nil(t, err)
+		assert.Equal(t, "shared secret", dec.String())
+	}
+
+	// Revoke bob by rewrapping for the remaining recipients.
+	rewrapped := new(bytes.Buffer)
+	_, err = Rewrap(bytes.NewReader(enc.Bytes()), rewrapped, []Unwrapper{KeyRingUnwrapper{StaticKey(master)}}, KeyRecipient(master), alice.Recipient())
+	assert.Nil(t, err)
+
+	_, err = CopyDecryptWith(bytes.NewReader(rewrapped.Bytes()), new(bytes.Buffer), bob)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	_, err = CopyDecryptWith(bytes.NewReader(rewrapped.Bytes()), new(bytes.Buffer), alice)
+	assert.Nil(t, err)
+
+	r, err := ParseX25519Recipient(alice.Recipient().String())
+	assert.Nil(t, err)
+	assert.Equal(t, alice.Recipient().String(), r.String())
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"io/ioutil"
+	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/jekki/gdss/common"
@@ -21,25 +24,147 @@ func OnPeer(peer p2p.Peer) error {
 	return nil
 }
 
-func makeServer(listenAddr, root string, nodes ...string) *server.FileServer {
+// storageConfig is the [storage] section of the settings.
+type storageConfig struct {
+	ContentAddressed bool
+	// Backend is one of "disk", "memory", "pack" or "s3".
+	Backend string
+	// S3 configures the "s3" backend. Every node keeps its files below a
+	// prefix of its own.
+	S3 store.S3Opts
+	// Chunking is "", "fixed" or "fastcdc", see FileServerOpts.Chunking.
+	Chunking string
+	// ChunkSize is the size of fixed chunks or the average size of content
+	// defined ones.
+	ChunkSize int
+}
+
+// chunking returns how files are split for replication, if at all.
+func (c storageConfig) chunking() store.ChunkerFunc {
+	size := c.ChunkSize
+	switch c.Chunking {
+	case "":
+		return nil
+	case "fixed":
+		if size <= 0 {
+			size = store.DefaultAvgChunkSize
+		}
+		return store.FixedChunking(size)
+	case "fastcdc":
+		if size <= 0 {
+			return store.DefaultChunking
+		}
+		if err := store.CheckChunkSizes(size/4, size, size*4); err != nil {
+			log.Fatalf("invalid storage.chunk_size %d: %v", size, err)
+		}
+		return store.ContentDefinedChunking(size/4, size, size*4)
+	default:
+		log.Fatalf("unknown chunking %q", c.Chunking)
+		return nil
+	}
+}
+
+// clusterConfig decides which nodes hold the replicas of a file.
+type clusterConfig struct {
+	ReplicationFactor int
+	VirtualNodes      int
+	WriteConsistency  string
+	ReadConsistency   string
+}
+
+// consistency parses the consistency level of setting.
+func consistency(setting string, level string) server.Consistency {
+	c, err := server.ParseConsistency(level)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", setting, err)
+	}
+	return c
+}
+
+// openBackend opens the storage backend configured for root.
+func (c storageConfig) openBackend(root string) store.Backend {
+	switch c.Backend {
+	case "", "disk":
+		return store.NewDiskBackend(root)
+	case "memory":
+		return store.NewMemoryBackend()
+	case "pack":
+		b, err := store.OpenPackBackend(filepath.Join(root, "pack"))
+		if err != nil {
+			log.Fatalf("opening pack backend: %v", err)
+		}
+		return b
+	case "s3":
+		opts := c.S3
+		opts.Prefix = path.Join(opts.Prefix, filepath.ToSlash(root))
+		b, err := store.NewS3Backend(opts)
+		if err != nil {
+			log.Fatalf("opening s3 backend: %v", err)
+		}
+		return b
+	default:
+		log.Fatalf("unknown storage backend %q", c.Backend)
+		return nil
+	}
+}
+
+func makeServer(listenAddr, root string, passphrase []byte, trustedKeys []ed25519.PublicKey, storage storageConfig, cluster clusterConfig, nodes ...string) *server.FileServer {
+	identity, err := gcrypto.LoadOrCreateIdentity(filepath.Join(root, "node.key"))
+	if err != nil {
+		log.Fatalf("loading node identity: %v", err)
+	}
+
+	keyStore, err := gcrypto.OpenKeyStore(filepath.Join(root, "keystore.json"), passphrase)
+	if err != nil {
+		log.Fatalf("opening key store: %v", err)
+	}
+
+	shareIdentity, err := gcrypto.LoadOrCreateX25519Identity(filepath.Join(root, "share.key"))
+	if err != nil {
+		log.Fatalf("loading share identity: %v", err)
+	}
+	log.Infof("node %s accepts shared files for recipient %s", identity.ID(), shareIdentity.Recipient())
+	log.Infof("node %s listening on %s with public key %x", identity.ID(), listenAddr, identity.PublicKey)
+
+	secureChannel, err := p2p.NewTLSChannel(identity)
+	if err != nil {
+		log.Fatalf("creating secure channel: %v", err)
+	}
+
 	tcpTransportOpts := p2p.TCPTransportOpts{
 		ListenAddress: listenAddr,
 		HandshakeFunc: p2p.NOPHandshakeFunc,
 		Decoder:       p2p.DefaultDecoder{},
+		SecureChannel: secureChannel,
 	}
 
 	tcptTransport := p2p.NewTCPTransport(tcpTransportOpts)
 
 	fileServerOpts := server.FileServerOpts{
-		EncKey:            gcrypto.NewEncryptionKey(),
+		Identity:          identity,
+		KeyRing:           keyStore,
+		ShareIdentity:     shareIdentity,
 		StorageRoot:       root,
 		PathTransformFunc: store.CASPathTransformFunc,
+		ContentAddressed:  storage.ContentAddressed,
+		Backend:           storage.openBackend(root),
+		Chunking:          storage.chunking(),
+		ReplicationFactor: cluster.ReplicationFactor,
+		VirtualNodes:      cluster.VirtualNodes,
+		WriteConsistency:  consistency("cluster.write_consistency", cluster.WriteConsistency),
+		ReadConsistency:   consistency("cluster.read_consistency", cluster.ReadConsistency),
 		Transport:         tcptTransport,
 		BootstrapNodes:    nodes,
 	}
 
 	s := server.NewFileServer(fileServerOpts)
 	tcptTransport.OnPeer = s.OnPeer
+	tcptTransport.OnPeerClose = s.OnPeerClose
+	tcptTransport.HandshakeFunc = p2p.NewHandshakeFunc(p2p.HandshakeOpts{
+		Info:        s.NodeInfo(),
+		Identity:    identity,
+		TrustedKeys: trustedKeys,
+	})
 
 	return s
 }
@@ -68,9 +193,46 @@ func main() {
 	root_test := conf.GetString("app.root_test")
 	listenAddr := fmt.Sprintf("%s:%d", host, port)
 
-	s1 := makeServer(listenAddr, root_test)
-	s2 := makeServer(":7000", root_test)
-	s3 := makeServer(":6666", root_test, ":7790", ":7000")
+	var trustedKeys []ed25519.PublicKey
+	for _, k := range conf.GetStringSlice("security.trusted_keys") {
+		key, err := gcrypto.ParsePublicKey(k)
+		if err != nil {
+			log.Fatalf("invalid trusted key %q: %v", k, err)
+		}
+		trustedKeys = append(trustedKeys, key)
+	}
+
+	passphrase := []byte(conf.GetString("security.keystore_passphrase"))
+	if len(passphrase) == 0 {
+		log.Warn("key store is protected by an empty passphrase, set GDSS_SECURITY_KEYSTORE_PASSPHRASE")
+	}
+
+	storage := storageConfig{
+		ContentAddressed: conf.GetBool("storage.content_addressed"),
+		Backend:          conf.GetString("storage.backend"),
+		Chunking:         conf.GetString("storage.chunking"),
+		ChunkSize:        conf.GetInt("storage.chunk_size"),
+		S3: store.S3Opts{
+			Endpoint:  conf.GetString("storage.s3.endpoint"),
+			Region:    conf.GetString("storage.s3.region"),
+			Bucket:    conf.GetString("storage.s3.bucket"),
+			Prefix:    conf.GetString("storage.s3.prefix"),
+			AccessKey: conf.GetString("storage.s3.access_key"),
+			SecretKey: conf.GetString("storage.s3.secret_key"),
+		},
+	}
+
+	cluster := clusterConfig{
+		ReplicationFactor: conf.GetInt("cluster.replication_factor"),
+		VirtualNodes:      conf.GetInt("cluster.virtual_nodes"),
+		WriteConsistency:  conf.GetString("cluster.write_consistency"),
+		ReadConsistency:   conf.GetString("cluster.read_consistency"),
+	}
+
+	// Every node owns its identity, so each one gets its own storage root.
+	s1 := makeServer(listenAddr, filepath.Join(root_test, "s1"), passphrase, trustedKeys, storage, cluster)
+	s2 := makeServer(":7000", filepath.Join(root_test, "s2"), passphrase, trustedKeys, storage, cluster)
+	s3 := makeServer(":6666", filepath.Join(root_test, "s3"), passphrase, trustedKeys, storage, cluster, ":7790", ":7000")
 
 	go func() { log.Fatal(s1.Start()) }()
 	time.Sleep(500 * time.Millisecond)
@@ -86,7 +248,7 @@ func main() {
 		data := bytes.NewReader([]byte("my big data file here!"))
 		s3.Store(key, data)
 
-		if err := s3.S.Delete(s3.ID, key); err != nil {
+		if err := s3.S.Delete(s3.ID, gcrypto.HashKey(key)); err != nil {
 			log.Fatal(err)
 		}
 
@@ -102,4 +264,9 @@ func main() {
 
 		log.Info(string(b))
 	}
+
+	// Unlike s3.S.Delete above, this removes the replicas on the peers too.
+	if err := s3.Delete("picture_0.png"); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -15,23 +15,25 @@ func (d *GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
+// DefaultDecoder reads length-prefixed frames (see ReadFrame) off the wire.
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
+	var f Frame
+	if err := ReadFrame(r, &f); err != nil {
 		return err
 	}
-	stream := peekBuf[0] == IncomingStream
-	if stream {
+
+	switch f.Type {
+	case IncomingMessage:
+	case IncomingStream, StreamOpen, StreamWindowUpdate, StreamClose, StreamReset:
 		msg.Stream = true
-		return nil
-	}
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
-		return err
+	default:
+		return ErrInvalidFrameType
 	}
-	msg.Payload = buf[:n]
+	msg.Type = f.Type
+	msg.Payload = f.Payload
+	msg.RequestID = f.RequestID
+	msg.StreamID = f.StreamID
 	return nil
 }
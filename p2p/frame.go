@@ -0,0 +1,124 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the version of the frame format spoken on the wire.
+const ProtocolVersion = 2
+
+const (
+	// FrameHeaderSize is the size in bytes of an encoded frame header.
+	FrameHeaderSize = 16
+	// MaxFrameSize is the largest payload a single frame is allowed to carry.
+	MaxFrameSize = 4 << 20
+)
+
+var (
+	// ErrFrameTooLarge is returned when a frame payload exceeds MaxFrameSize.
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+	// ErrInvalidFrameVersion is returned when a frame was written with an
+	// unsupported protocol version.
+	ErrInvalidFrameVersion = errors.New("invalid frame version")
+	// ErrInvalidFrameType is returned when a frame carries an unknown type.
+	ErrInvalidFrameType = errors.New("invalid frame type")
+)
+
+// FrameHeader precedes every frame on the wire.
+//
+//	0       1       2               4               8              12              16
+//	+-------+-------+---------------+---------------+---------------+---------------+
+//	|version| type  |     flags     |    length     |  request id   |   stream id   |
+//	+-------+-------+---------------+---------------+---------------+---------------+
+//
+// All multi-byte fields are big endian. The request id is zero for frames
+// that are not part of a request, the stream id for frames that do not
+// belong to a stream.
+type FrameHeader struct {
+	Version   uint8
+	Type      uint8
+	Flags     uint16
+	Length    uint32
+	RequestID uint32
+	StreamID  uint32
+}
+
+// Frame is a single length-prefixed unit of data sent between two peers.
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// NewFrame returns a frame of the given type carrying payload.
+func NewFrame(typ uint8, payload []byte) *Frame {
+	return &Frame{
+		FrameHeader: FrameHeader{
+			Version: ProtocolVersion,
+			Type:    typ,
+			Length:  uint32(len(payload)),
+		},
+		Payload: payload,
+	}
+}
+
+func (h *FrameHeader) encode(buf []byte) {
+	buf[0] = h.Version
+	buf[1] = h.Type
+	binary.BigEndian.PutUint16(buf[2:4], h.Flags)
+	binary.BigEndian.PutUint32(buf[4:8], h.Length)
+	binary.BigEndian.PutUint32(buf[8:12], h.RequestID)
+	binary.BigEndian.PutUint32(buf[12:16], h.StreamID)
+}
+
+func (h *FrameHeader) decode(buf []byte) {
+	h.Version = buf[0]
+	h.Type = buf[1]
+	h.Flags = binary.BigEndian.Uint16(buf[2:4])
+	h.Length = binary.BigEndian.Uint32(buf[4:8])
+	h.RequestID = binary.BigEndian.Uint32(buf[8:12])
+	h.StreamID = binary.BigEndian.Uint32(buf[12:16])
+}
+
+// WriteFrame encodes f onto w with a single Write call, so that frames written
+// under a lock are never interleaved with other writers.
+func WriteFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	f.Length = uint32(len(f.Payload))
+
+	buf := make([]byte, FrameHeaderSize+len(f.Payload))
+	f.FrameHeader.encode(buf)
+	copy(buf[FrameHeaderSize:], f.Payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame from r into f.
+func ReadFrame(r io.Reader, f *Frame) error {
+	var hdr [FrameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	f.FrameHeader.decode(hdr[:])
+
+	if f.Version != ProtocolVersion {
+		return fmt.Errorf("%w: %d", ErrInvalidFrameVersion, f.Version)
+	}
+	if f.Length > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	f.Payload = make([]byte, f.Length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
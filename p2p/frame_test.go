@@ -0,0 +1,59 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeBackToBackFrames(t *testing.T) {
+	large := bytes.Repeat([]byte("gdss"), 64*1024)
+	small := []byte("hello")
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, NewFrame(IncomingMessage, large)))
+	assert.Nil(t, WriteFrame(buf, NewFrame(IncomingMessage, small)))
+	assert.Nil(t, WriteFrame(buf, NewFrame(IncomingStream, nil)))
+
+	dec := DefaultDecoder{}
+
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, large, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, small, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.True(t, rpc.Stream)
+}
+
+func TestFrameLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.ErrorIs(t, WriteFrame(buf, NewFrame(IncomingMessage, make([]byte, MaxFrameSize+1))), ErrFrameTooLarge)
+
+	f := NewFrame(IncomingMessage, []byte("x"))
+	f.Version = ProtocolVersion + 1
+	assert.Nil(t, WriteFrame(buf, f))
+	assert.ErrorIs(t, ReadFrame(buf, &Frame{}), ErrInvalidFrameVersion)
+}
+
+func TestFrameRequestID(t *testing.T) {
+	buf := new(bytes.Buffer)
+	f := NewFrame(IncomingMessage, []byte("request"))
+	f.RequestID = 42
+	assert.Nil(t, WriteFrame(buf, f))
+	assert.Nil(t, WriteFrame(buf, NewFrame(IncomingMessage, []byte("message"))))
+
+	dec := DefaultDecoder{}
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, uint32(42), rpc.RequestID)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, uint32(0), rpc.RequestID)
+}
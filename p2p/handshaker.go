@@ -1,12 +1,191 @@
 package p2p
 
-import "errors"
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jekki/gdss/gcrypto"
+)
 
 // ErrInvalidPeer is returned if the handsjake beteen
 // the local and remote
 var ErrInvalidHandshake = errors.New("invalid handshake")
 
+// CapabilityStreams is advertised by nodes that multiplex streams over a
+// connection.
+const CapabilityStreams = "streams"
+
+// handshakeContext is mixed into every handshake signature so that they
+// cannot be replayed in another protocol.
+const handshakeContext = "gdss-handshake-v1"
+
 // HandshakeFunc is a function that performs a handshake with the peer.
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error { return nil }
+
+// PeerInfo describes a node as advertised during the handshake.
+type PeerInfo struct {
+	ID           string
+	ListenAddr   string
+	Version      uint8
+	Capabilities []string
+	PublicKey    []byte
+}
+
+// HasCapability reports whether the node advertised capability c.
+func (i PeerInfo) HasCapability(c string) bool {
+	for _, have := range i.Capabilities {
+		if have == c {
+			return true
+		}
+	}
+	return false
+}
+
+// HandshakeOpts configures the handshake built by NewHandshakeFunc.
+type HandshakeOpts struct {
+	// Info is what we advertise to the remote.
+	Info PeerInfo
+	// Identity, when set, authenticates both sides: we prove possession of
+	// our key and require the remote to do the same for the key its node ID
+	// is derived from.
+	Identity *gcrypto.Identity
+	// TrustedKeys optionally restricts the remotes we accept to this list.
+	// It is ignored if Identity is not set.
+	TrustedKeys []ed25519.PublicKey
+}
+
+type handshakeHello struct {
+	Info  PeerInfo
+	Nonce []byte
+}
+
+// NewHandshakeFunc returns a HandshakeFunc that exchanges PeerInfo with the
+// remote and records the remote's on the peer. Peers speaking another
+// protocol version, claiming our own ID, or failing authentication are
+// rejected with ErrInvalidHandshake.
+func NewHandshakeFunc(opts HandshakeOpts) HandshakeFunc {
+	local := opts.Info
+	if local.Version == 0 {
+		local.Version = ProtocolVersion
+	}
+	if opts.Identity != nil {
+		local.ID = opts.Identity.ID()
+		local.PublicKey = opts.Identity.PublicKey
+	}
+
+	return func(p Peer) error {
+		hello := handshakeHello{Info: local}
+		if opts.Identity != nil {
+			hello.Nonce = make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, hello.Nonce); err != nil {
+				return err
+			}
+		}
+
+		var remote handshakeHello
+		if err := exchangeHandshake(p, hello, &remote); err != nil {
+			return err
+		}
+		if remote.Info.Version != local.Version {
+			return fmt.Errorf("%w: protocol version %d, want %d", ErrInvalidHandshake, remote.Info.Version, local.Version)
+		}
+		if len(remote.Info.ID) == 0 {
+			return fmt.Errorf("%w: missing node id", ErrInvalidHandshake)
+		}
+		if remote.Info.ID == local.ID {
+			return fmt.Errorf("%w: connected to self", ErrInvalidHandshake)
+		}
+
+		if opts.Identity != nil {
+			if err := authenticate(p, opts, local, hello, remote); err != nil {
+				return err
+			}
+		}
+
+		p.SetInfo(remote.Info)
+		return nil
+	}
+}
+
+// authenticate proves possession of our identity key to the remote by
+// signing its nonce, and verifies the remote's signature over ours.
+func authenticate(p Peer, opts HandshakeOpts, local PeerInfo, hello, remote handshakeHello) error {
+	pub := ed25519.PublicKey(remote.Info.PublicKey)
+	if len(pub) != ed25519.PublicKeySize || len(remote.Nonce) == 0 {
+		return fmt.Errorf("%w: remote did not present an identity", ErrInvalidHandshake)
+	}
+	if gcrypto.NodeID(pub) != remote.Info.ID {
+		return fmt.Errorf("%w: node id does not match public key", ErrInvalidHandshake)
+	}
+	if len(opts.TrustedKeys) > 0 && !isTrusted(opts.TrustedKeys, pub) {
+		return fmt.Errorf("%w: untrusted node %s", ErrInvalidHandshake, remote.Info.ID)
+	}
+
+	proof := opts.Identity.Sign(handshakeTranscript(remote.Nonce, local.ID, remote.Info.ID))
+
+	var remoteProof []byte
+	if err := exchangeHandshake(p, proof, &remoteProof); err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, handshakeTranscript(hello.Nonce, remote.Info.ID, local.ID), remoteProof) {
+		return fmt.Errorf("%w: bad signature from %s", ErrInvalidHandshake, remote.Info.ID)
+	}
+	return nil
+}
+
+// handshakeTranscript is what a node signs: the nonce chosen by the other
+// side, followed by the signer's and the verifier's node IDs.
+func handshakeTranscript(nonce []byte, signer, verifier string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(handshakeContext)
+	buf.Write(nonce)
+	buf.WriteString(signer)
+	buf.WriteString(verifier)
+	return buf.Bytes()
+}
+
+func isTrusted(keys []ed25519.PublicKey, pub ed25519.PublicKey) bool {
+	for _, key := range keys {
+		if key.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeHandshake sends v to the remote and decodes the remote's reply
+// into out. The send runs concurrently with the read so that two peers
+// handshaking over an unbuffered connection cannot block each other.
+func exchangeHandshake(p Peer, v any, out any) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- WriteFrame(p, NewFrame(HandshakeMessage, buf.Bytes()))
+	}()
+
+	var f Frame
+	if err := ReadFrame(p, &f); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+	}
+	if err := <-errch; err != nil {
+		return err
+	}
+	if f.Type != HandshakeMessage {
+		return fmt.Errorf("%w: unexpected frame type %d", ErrInvalidHandshake, f.Type)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(f.Payload)).Decode(out); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+
+	"github.com/jekki/gdss/gcrypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePair(a, b HandshakeOpts) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	errch := make(chan error, 1)
+	go func() {
+		err := NewHandshakeFunc(b)(p2)
+		if err != nil {
+			p2.Close()
+		}
+		errch <- err
+	}()
+	err := NewHandshakeFunc(a)(p1)
+	if err != nil {
+		p1.Close()
+	}
+	return p1, p2, err, <-errch
+}
+
+func newIdentity(t *testing.T) *gcrypto.Identity {
+	id, err := gcrypto.NewIdentity()
+	assert.Nil(t, err)
+	return id
+}
+
+func TestHandshake(t *testing.T) {
+	a := HandshakeOpts{Info: PeerInfo{ID: "node-a", ListenAddr: ":3000", Capabilities: []string{CapabilityStreams}}}
+	b := HandshakeOpts{Info: PeerInfo{ID: "node-b", ListenAddr: ":4000"}}
+
+	p1, p2, err1, err2 := handshakePair(a, b)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	assert.Equal(t, "node-b", p1.Info().ID)
+	assert.Equal(t, ":4000", p1.Info().ListenAddr)
+	assert.Equal(t, "node-a", p2.Info().ID)
+	assert.True(t, p2.Info().HasCapability(CapabilityStreams))
+}
+
+func TestHandshakeRejectsIncompatiblePeers(t *testing.T) {
+	a := HandshakeOpts{Info: PeerInfo{ID: "node-a"}}
+	b := HandshakeOpts{Info: PeerInfo{ID: "node-b", Version: ProtocolVersion + 1}}
+
+	_, _, err1, err2 := handshakePair(a, b)
+	assert.ErrorIs(t, err1, ErrInvalidHandshake)
+	assert.ErrorIs(t, err2, ErrInvalidHandshake)
+
+	_, _, err1, err2 = handshakePair(a, a)
+	assert.ErrorIs(t, err1, ErrInvalidHandshake)
+	assert.ErrorIs(t, err2, ErrInvalidHandshake)
+}
+
+func TestHandshakeAuthenticatesIdentities(t *testing.T) {
+	idA, idB := newIdentity(t), newIdentity(t)
+	a := HandshakeOpts{Identity: idA}
+	b := HandshakeOpts{Identity: idB, TrustedKeys: []ed25519.PublicKey{idA.PublicKey}}
+
+	p1, p2, err1, err2 := handshakePair(a, b)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, idB.ID(), p1.Info().ID)
+	assert.Equal(t, idA.ID(), p2.Info().ID)
+
+	// b only trusts a, so a stranger is turned away.
+	stranger := HandshakeOpts{Identity: newIdentity(t)}
+	_, _, _, err2 = handshakePair(stranger, b)
+	assert.ErrorIs(t, err2, ErrInvalidHandshake)
+
+	// Claiming someone else's ID without their key fails.
+	impostor := HandshakeOpts{Info: PeerInfo{ID: idA.ID(), PublicKey: idA.PublicKey}}
+	_, _, _, err2 = handshakePair(impostor, b)
+	assert.ErrorIs(t, err2, ErrInvalidHandshake)
+}
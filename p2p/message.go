@@ -1,8 +1,20 @@
 package p2p
 
+// Frame types.
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	// IncomingStream carries a chunk of stream data.
+	IncomingStream = 0x2
+	// StreamOpen announces a new stream to the remote.
+	StreamOpen = 0x3
+	// StreamWindowUpdate grants the remote more send window on a stream.
+	StreamWindowUpdate = 0x4
+	// StreamClose half-closes a stream: the sender will write no more data.
+	StreamClose = 0x5
+	// StreamReset aborts a stream in both directions.
+	StreamReset = 0x6
+	// HandshakeMessage carries a PeerInfo during the handshake.
+	HandshakeMessage = 0x7
 )
 
 // RPC holds any arbitrary data that is being sent over the
@@ -11,4 +23,9 @@ type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	Type    uint8
+	// RequestID ties a request and its response together. It is zero for
+	// messages that are neither.
+	RequestID uint32
+	StreamID  uint32
 }
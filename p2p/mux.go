@@ -0,0 +1,369 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// streamWindowSize is the number of unread bytes a stream buffers before
+	// the remote has to wait for a window update.
+	streamWindowSize = 256 * 1024
+	// maxStreamChunk is the largest data frame a stream writes at once.
+	maxStreamChunk = 32 * 1024
+)
+
+// acceptTimeout is how long a stream opened by the remote waits to be
+// accepted before it is reset, so streams nobody takes do not hold on to
+// the data buffered for them until the connection closes.
+var acceptTimeout = 30 * time.Second
+
+var (
+	// ErrStreamNotFound is returned when a stream id is unknown to the peer.
+	ErrStreamNotFound = errors.New("stream not found")
+	// ErrStreamClosed is returned when writing to a closed stream.
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamReset is returned once a stream has been reset by either side.
+	ErrStreamReset = errors.New("stream reset")
+)
+
+// Stream is a logical, flow-controlled byte stream multiplexed over a Peer.
+// Close half-closes the stream, Reset aborts it in both directions.
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
+	Reset() error
+}
+
+// mux keeps track of the streams running over a single TCPPeer.
+type mux struct {
+	lock    sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+}
+
+func newMux(outbound bool) *mux {
+	// Outbound peers use odd stream ids and inbound peers even ones, so the
+	// two sides never pick the same id.
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+	return &mux{
+		streams: make(map[uint32]*muxStream),
+		nextID:  nextID,
+	}
+}
+
+// OpenStream opens a new stream to the remote.
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	p.mux.lock.Lock()
+	if p.mux.err != nil {
+		p.mux.lock.Unlock()
+		return nil, p.mux.err
+	}
+	id := p.mux.nextID
+	p.mux.nextID += 2
+	st := newMuxStream(p, id)
+	p.mux.streams[id] = st
+	p.mux.lock.Unlock()
+
+	if err := p.writeStreamFrame(StreamOpen, id, nil); err != nil {
+		p.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream returns the stream with the given id that was opened by the
+// remote. Streams not accepted within acceptTimeout are reset.
+func (p *TCPPeer) AcceptStream(id uint32) (Stream, error) {
+	p.mux.lock.Lock()
+	defer p.mux.lock.Unlock()
+
+	st, ok := p.mux.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrStreamNotFound, id)
+	}
+	if st.acceptTimer != nil {
+		st.acceptTimer.Stop()
+		st.acceptTimer = nil
+	}
+	return st, nil
+}
+
+// expireStream resets st, which the remote opened, unless it was accepted
+// in the meantime.
+func (p *TCPPeer) expireStream(st *muxStream) {
+	p.mux.lock.Lock()
+	if st.acceptTimer == nil || p.mux.streams[st.id] != st {
+		p.mux.lock.Unlock()
+		return
+	}
+	delete(p.mux.streams, st.id)
+	p.mux.lock.Unlock()
+
+	st.Reset()
+}
+
+// Streams returns how many streams are open on the connection.
+func (p *TCPPeer) Streams() int {
+	p.mux.lock.Lock()
+	defer p.mux.lock.Unlock()
+	return len(p.mux.streams)
+}
+
+func (p *TCPPeer) writeStreamFrame(typ uint8, id uint32, payload []byte) error {
+	f := NewFrame(typ, payload)
+	f.StreamID = id
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	return WriteFrame(p.Conn, f)
+}
+
+func (p *TCPPeer) removeStream(id uint32) {
+	p.mux.lock.Lock()
+	defer p.mux.lock.Unlock()
+	delete(p.mux.streams, id)
+}
+
+// handleStreamFrame dispatches a stream frame read off the connection. It
+// never blocks on a stream's reader, so one slow stream cannot stall the
+// others sharing the connection.
+func (p *TCPPeer) handleStreamFrame(rpc RPC) error {
+	p.mux.lock.Lock()
+	st, ok := p.mux.streams[rpc.StreamID]
+	if rpc.Type == StreamOpen {
+		if ok {
+			p.mux.lock.Unlock()
+			return fmt.Errorf("stream %d already open", rpc.StreamID)
+		}
+		st := newMuxStream(p, rpc.StreamID)
+		st.acceptTimer = time.AfterFunc(acceptTimeout, func() { p.expireStream(st) })
+		p.mux.streams[rpc.StreamID] = st
+		p.mux.lock.Unlock()
+		return nil
+	}
+	p.mux.lock.Unlock()
+
+	if !ok {
+		// Frames for streams we already dropped are harmless.
+		return nil
+	}
+
+	switch rpc.Type {
+	case IncomingStream:
+		if err := st.push(rpc.Payload); err != nil {
+			st.Reset()
+		}
+	case StreamWindowUpdate:
+		if len(rpc.Payload) != 4 {
+			return fmt.Errorf("invalid window update on stream %d", rpc.StreamID)
+		}
+		st.grant(binary.BigEndian.Uint32(rpc.Payload))
+	case StreamClose:
+		st.remoteClose()
+	case StreamReset:
+		st.abort(fmt.Errorf("%w by remote: %s", ErrStreamReset, rpc.Payload))
+	}
+	return nil
+}
+
+// closeStreams aborts every stream on the peer, used when the underlying
+// connection goes away.
+func (p *TCPPeer) closeStreams(err error) {
+	p.mux.lock.Lock()
+	p.mux.err = err
+	streams := p.mux.streams
+	p.mux.streams = make(map[uint32]*muxStream)
+	p.mux.lock.Unlock()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+type muxStream struct {
+	peer *TCPPeer
+	id   uint32
+	// acceptTimer resets a stream opened by the remote until it is
+	// accepted, it is guarded by the lock of the peer's mux.
+	acceptTimer *time.Timer
+
+	lock         sync.Mutex
+	cond         *sync.Cond
+	recvBuf      bytes.Buffer
+	unacked      uint32
+	sendWindow   uint32
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newMuxStream(p *TCPPeer, id uint32) *muxStream {
+	st := &muxStream{
+		peer:       p,
+		id:         id,
+		sendWindow: streamWindowSize,
+	}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+func (s *muxStream) ID() uint32 {
+	return s.id
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	s.lock.Lock()
+	for s.recvBuf.Len() == 0 && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.recvBuf.Len() == 0 {
+		defer s.lock.Unlock()
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+
+	n, _ := s.recvBuf.Read(b)
+	s.unacked += uint32(n)
+
+	// Hand out window in batches, but always once the buffer is drained so
+	// a writer waiting on a full window can make progress.
+	var grant uint32
+	if s.unacked >= streamWindowSize/4 || s.recvBuf.Len() == 0 {
+		grant = s.unacked
+		s.unacked = 0
+	}
+	s.lock.Unlock()
+
+	if grant > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], grant)
+		if err := s.peer.writeStreamFrame(StreamWindowUpdate, s.id, payload[:]); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		s.lock.Lock()
+		for s.sendWindow == 0 && !s.localClosed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.lock.Unlock()
+			return written, s.err
+		}
+		if s.localClosed {
+			s.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := len(b)
+		if n > maxStreamChunk {
+			n = maxStreamChunk
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.lock.Unlock()
+
+		if err := s.peer.writeStreamFrame(IncomingStream, s.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close half-closes the stream. Data sent by the remote can still be read
+// until it closes its side as well.
+func (s *muxStream) Close() error {
+	s.lock.Lock()
+	if s.localClosed || s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	done := s.remoteClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done {
+		s.peer.removeStream(s.id)
+	}
+	return s.peer.writeStreamFrame(StreamClose, s.id, nil)
+}
+
+// Reset aborts the stream in both directions.
+func (s *muxStream) Reset() error {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.lock.Unlock()
+
+	s.abort(ErrStreamReset)
+	return s.peer.writeStreamFrame(StreamReset, s.id, nil)
+}
+
+func (s *muxStream) push(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil || s.remoteClosed {
+		return nil
+	}
+	if s.recvBuf.Len()+len(b) > streamWindowSize {
+		return fmt.Errorf("stream %d: remote exceeded flow control window", s.id)
+	}
+	s.recvBuf.Write(b)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *muxStream) grant(n uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sendWindow += n
+	s.cond.Broadcast()
+}
+
+func (s *muxStream) remoteClose() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	done := s.localClosed
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if done {
+		s.peer.removeStream(s.id)
+	}
+}
+
+func (s *muxStream) abort(err error) {
+	s.lock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	s.peer.removeStream(s.id)
+}
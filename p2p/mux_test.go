@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pipePeers() (*TCPPeer, *TCPPeer) {
+	c1, c2 := net.Pipe()
+	a, b := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+	go serveFrames(a)
+	go serveFrames(b)
+	return a, b
+}
+
+func serveFrames(p *TCPPeer) {
+	for {
+		var rpc RPC
+		if err := (DefaultDecoder{}).Decode(p.Conn, &rpc); err != nil {
+			p.closeStreams(err)
+			return
+		}
+		if rpc.Stream {
+			p.handleStreamFrame(rpc)
+		}
+	}
+}
+
+// acceptStream waits for the open frame of stream id to be processed.
+func acceptStream(p *TCPPeer, id uint32) (Stream, error) {
+	var (
+		st  Stream
+		err error
+	)
+	for i := 0; i < 100; i++ {
+		if st, err = p.AcceptStream(id); err == nil {
+			return st, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, err
+}
+
+func TestMuxConcurrentStreams(t *testing.T) {
+	a, b := pipePeers()
+	defer a.Close()
+
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), 3*streamWindowSize),
+		bytes.Repeat([]byte("b"), streamWindowSize/2),
+	}
+
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		st, err := a.OpenStream()
+		assert.Nil(t, err)
+
+		wg.Add(2)
+		go func(st Stream, payload []byte) {
+			defer wg.Done()
+			_, err := st.Write(payload)
+			assert.Nil(t, err)
+			assert.Nil(t, st.Close())
+		}(st, payload)
+
+		go func(id uint32, payload []byte) {
+			defer wg.Done()
+			remote, err := acceptStream(b, id)
+			assert.Nil(t, err)
+			got, err := io.ReadAll(remote)
+			assert.Nil(t, err)
+			assert.Equal(t, payload, got)
+			assert.Nil(t, remote.Close())
+		}(st.ID(), payload)
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	a, b := pipePeers()
+	defer a.Close()
+
+	st, err := a.OpenStream()
+	assert.Nil(t, err)
+	remote, err := acceptStream(b, st.ID())
+	assert.Nil(t, err)
+
+	assert.Nil(t, remote.Reset())
+	_, err = io.ReadAll(st)
+	assert.ErrorIs(t, err, ErrStreamReset)
+
+	_, err = b.AcceptStream(st.ID())
+	assert.ErrorIs(t, err, ErrStreamNotFound)
+}
+
+func TestMuxStreamNotAccepted(t *testing.T) {
+	defer func(timeout time.Duration) { acceptTimeout = timeout }(acceptTimeout)
+	acceptTimeout = 50 * time.Millisecond
+
+	a, b := pipePeers()
+	defer a.Close()
+
+	accepted, err := a.OpenStream()
+	assert.Nil(t, err)
+	remote, err := acceptStream(b, accepted.ID())
+	assert.Nil(t, err)
+
+	// A stream nobody accepts is reset along with the data buffered for it.
+	ignored, err := a.OpenStream()
+	assert.Nil(t, err)
+	_, err = ignored.Write([]byte("data"))
+	assert.Nil(t, err)
+	_, err = io.ReadAll(ignored)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	assert.Equal(t, 1, b.Streams())
+
+	// The accepted one keeps working.
+	_, err = accepted.Write([]byte("data"))
+	assert.Nil(t, err)
+	assert.Nil(t, accepted.Close())
+	got, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), got)
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+// SecureChannelFunc upgrades the connection of a peer that completed the
+// handshake to a confidential, integrity-protected one. remote is what the
+// peer advertised during the handshake.
+type SecureChannelFunc func(conn net.Conn, remote PeerInfo, outbound bool) (net.Conn, error)
+
+// NewTLSChannel returns a SecureChannelFunc that runs TLS 1.3 over the
+// connection, using a self-signed certificate for the node's identity key.
+// The remote certificate must carry the same ed25519 key the remote proved
+// possession of during the handshake, so the handshake must be an
+// authenticated one (see HandshakeOpts.Identity).
+func NewTLSChannel(id *gcrypto.Identity) (SecureChannelFunc, error) {
+	cert, err := selfSignedCertificate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(conn net.Conn, remote PeerInfo, outbound bool) (net.Conn, error) {
+		remoteKey := ed25519.PublicKey(remote.PublicKey)
+		if len(remoteKey) != ed25519.PublicKeySize {
+			return nil, errors.New("secure channel requires an authenticated handshake")
+		}
+
+		conf := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+			ClientAuth:   tls.RequireAnyClientCert,
+			// Node certificates are self-signed, the chain is checked
+			// against the handshake identity instead.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyNodeCertificate(rawCerts, remoteKey)
+			},
+		}
+
+		var tlsConn *tls.Conn
+		if outbound {
+			tlsConn = tls.Client(conn, conf)
+		} else {
+			tlsConn = tls.Server(conn, conf)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		return tlsConn, nil
+	}, nil
+}
+
+func verifyNodeCertificate(rawCerts [][]byte, want ed25519.PublicKey) error {
+	if len(rawCerts) == 0 {
+		return errors.New("remote sent no certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || !pub.Equal(want) {
+		return errors.New("certificate does not match handshake identity")
+	}
+	return nil
+}
+
+func selfSignedCertificate(id *gcrypto.Identity) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: id.ID()},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, id.PublicKey, id.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  id.PrivateKey,
+	}, nil
+}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSChannel(t *testing.T) {
+	idA, idB := newIdentity(t), newIdentity(t)
+	p1, p2, err1, err2 := handshakePair(HandshakeOpts{Identity: idA}, HandshakeOpts{Identity: idB})
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	chA, err := NewTLSChannel(idA)
+	assert.Nil(t, err)
+	chB, err := NewTLSChannel(idB)
+	assert.Nil(t, err)
+
+	errch := make(chan error, 1)
+	go func() {
+		conn, err := chB(p2.Conn, p2.Info(), false)
+		if err == nil {
+			p2.Conn = conn
+			err = p2.Send([]byte("over tls"))
+		}
+		errch <- err
+	}()
+
+	conn, err := chA(p1.Conn, p1.Info(), true)
+	assert.Nil(t, err)
+	p1.Conn = conn
+
+	var rpc RPC
+	assert.Nil(t, DefaultDecoder{}.Decode(p1, &rpc))
+	assert.Nil(t, <-errch)
+	assert.Equal(t, []byte("over tls"), rpc.Payload)
+}
+
+func TestTLSChannelRejectsOtherKeys(t *testing.T) {
+	idA, idB := newIdentity(t), newIdentity(t)
+	p1, p2, err1, err2 := handshakePair(HandshakeOpts{Identity: idA}, HandshakeOpts{Identity: idB})
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+
+	// b presents a certificate for a key it did not authenticate with.
+	chA, err := NewTLSChannel(idA)
+	assert.Nil(t, err)
+	chB, err := NewTLSChannel(newIdentity(t))
+	assert.Nil(t, err)
+
+	go func() {
+		if _, err := chB(p2.Conn, p2.Info(), false); err != nil {
+			p2.Close()
+		}
+	}()
+
+	_, err = chA(p1.Conn, p1.Info(), true)
+	assert.NotNil(t, err)
+}
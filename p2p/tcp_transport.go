@@ -12,7 +12,11 @@ import (
 type TCPPeer struct {
 	net.Conn
 	outbound bool
-	wg       *sync.WaitGroup
+	sendLock sync.Mutex
+	mux      *mux
+
+	infoLock sync.RWMutex
+	info     PeerInfo
 }
 
 // NewTCPPeer creates a new TCPPeer.
@@ -20,7 +24,7 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		mux:      newMux(outbound),
 	}
 }
 
@@ -29,21 +33,52 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 // 	return p.conn
 // }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// Info returns what the remote advertised during the handshake.
+func (p *TCPPeer) Info() PeerInfo {
+	p.infoLock.RLock()
+	defer p.infoLock.RUnlock()
+	return p.info
+}
+
+// SetInfo records what the remote advertised during the handshake.
+func (p *TCPPeer) SetInfo(info PeerInfo) {
+	p.infoLock.Lock()
+	defer p.infoLock.Unlock()
+	p.info = info
+}
+
+// Outbound reports whether this node dialed the connection.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
 }
 
-// Close the connection.
+// Send writes b to the remote as a single message frame.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.SendRequest(0, b)
+}
+
+// SendRequest writes b to the remote as a single message frame carrying
+// requestID in its header.
+func (p *TCPPeer) SendRequest(requestID uint32, b []byte) error {
+	f := NewFrame(IncomingMessage, b)
+	f.RequestID = requestID
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	return WriteFrame(p.Conn, f)
 }
 
 type TCPTransportOpts struct {
 	ListenAddress string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
+	// SecureChannel, when set, wraps every connection right after the
+	// handshake so that all further traffic is encrypted.
+	SecureChannel SecureChannelFunc
 	OnPeer        func(Peer) error
+	// OnPeerClose is called once the connection of a peer OnPeer accepted
+	// is gone, along with why.
+	OnPeerClose func(Peer, error)
 }
 type TCPTransport struct {
 	TCPTransportOpts
@@ -53,6 +88,9 @@ type TCPTransport struct {
 
 // NewTCPTransport creates a new TCPTransport.
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.HandshakeFunc == nil {
+		opts.HandshakeFunc = NOPHandshakeFunc
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
@@ -124,26 +162,48 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	peerAddr := conn.RemoteAddr().String()
 	logger := log.WithPeerContext(peerAddr, t.ListenAddress)
 
+	var accepted bool
+	peer := NewTCPPeer(conn, outbound)
 	defer func() {
 		if err != nil {
-			log.Error("dropping peer connection: %s", err)
+			log.Errorf("dropping peer connection: %s", err)
 			conn.Close()
+			peer.closeStreams(err)
+		}
+		if accepted && t.OnPeerClose != nil {
+			t.OnPeerClose(peer, err)
 		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
-
 	if err = t.HandshakeFunc(peer); err != nil {
 		logger.Errorf("TCP handshake error: %v", err)
 		return
 	}
 
+	if t.SecureChannel != nil {
+		var secured net.Conn
+		if secured, err = t.SecureChannel(conn, peer.Info(), outbound); err != nil {
+			logger.Errorf("secure channel error: %v", err)
+			return
+		}
+		conn = secured
+		peer.Conn = secured
+	}
+
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
 			logger.Errorf("OnPeer callback error: %v", err)
 			return
 		}
 	}
+	accepted = true
+
+	// Peers that completed a handshake are known by their node ID rather
+	// than by their (possibly ephemeral) remote address.
+	from := peer.Info().ID
+	if len(from) == 0 {
+		from = peerAddr
+	}
 
 	for {
 		rpc := RPC{}
@@ -152,13 +212,13 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
+		rpc.From = from
 
 		if rpc.Stream {
-			peer.wg.Add(1)
-			logger.Info("incoming stream, waiting...")
-			peer.wg.Wait()
-			logger.Info("stream closed, resuming read loop")
+			if err = peer.handleStreamFrame(rpc); err != nil {
+				logger.Errorf("stream error: %v", err)
+				return
+			}
 			continue
 		}
 		t.rpcch <- rpc
@@ -6,7 +6,17 @@ import "net"
 type Peer interface {
 	net.Conn
 	Send([]byte) error
-	CloseStream()
+	// SendRequest is Send for a message that is part of a request, see
+	// RPC.RequestID.
+	SendRequest(requestID uint32, b []byte) error
+	OpenStream() (Stream, error)
+	AcceptStream(uint32) (Stream, error)
+	Info() PeerInfo
+	SetInfo(PeerInfo)
+	// Outbound reports whether this node dialed the connection.
+	Outbound() bool
+	// Streams returns how many streams are open on the connection.
+	Streams() int
 }
 
 // Transport is anything that handles the communication
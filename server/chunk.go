@@ -0,0 +1,472 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+	"github.com/jekki/gdss/store"
+)
+
+// maxChunkFrame bounds the size of the sealed chunks read from peers.
+const maxChunkFrame = 64 << 20
+
+// MessageGetChunks asks for the chunks with Digests to be written back on
+// the stream StreamID, in order.
+type MessageGetChunks struct {
+	Digests  []string
+	StreamID uint32
+}
+
+// fileHeader precedes a file written back for MessageGetFile.
+type fileHeader struct {
+	Size int64
+	// Chunked is set for manifests of files replicated chunk by chunk.
+	Chunked bool
+	// Digest is the SHA-256 digest of the bytes that follow, and Stored
+	// when the replica stored them in Unix nanoseconds.
+	Digest [sha256.Size]byte
+	Stored int64
+}
+
+// fileHeaderOf returns the header of the stored file fi describes.
+func fileHeaderOf(fi store.FileInfo) fileHeader {
+	header := fileHeader{Size: fi.Size, Chunked: len(fi.Chunks) > 0, Stored: fi.Created.UnixNano()}
+	hex.Decode(header.Digest[:], []byte(fi.Digest))
+	return header
+}
+
+// manifest lists the chunks of a file replicated with chunking, in order.
+// Replicas hold it encrypted like any other file, so only the recipients of
+// the file learn the keys of its chunks.
+type manifest struct {
+	Size   int64           `json:"size"`
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+type manifestChunk struct {
+	// Digest is the hex encoded SHA-256 digest of the sealed chunk, which
+	// replicas store it under.
+	Digest string `json:"digest"`
+	// Key is what the chunk is sealed with, see gcrypto.SealConvergent.
+	Key  []byte `json:"key"`
+	Size int    `json:"size"`
+}
+
+func (m *manifest) digests() []string {
+	digests := make([]string, len(m.Chunks))
+	for i, c := range m.Chunks {
+		digests[i] = c.Digest
+	}
+	return digests
+}
+
+// sealChunk seals chunk with a key derived from its contents and
+// activeKey, so replicas deduplicate the chunks of this node's files
+// without reading them.
+func sealChunk(activeKey []byte, chunk []byte) (manifestChunk, []byte, error) {
+	digest := sha256.Sum256(chunk)
+	key := gcrypto.ConvergentKey(activeKey, digest[:])
+	sealed, err := gcrypto.SealConvergent(key, chunk)
+	if err != nil {
+		return manifestChunk{}, nil, err
+	}
+	sum := sha256.Sum256(sealed)
+	return manifestChunk{Digest: hex.EncodeToString(sum[:]), Key: key, Size: len(chunk)}, sealed, nil
+}
+
+// eachChunk seals the chunks of this node's copy of the file stored under
+// hashedKey one at a time with activeKey and passes them to fn. Chunks want
+// returns false for are skipped without being sealed, a nil want takes
+// every chunk.
+func (s *FileServer) eachChunk(hashedKey string, activeKey []byte, want func(i int) bool, fn func(i int, c manifestChunk, sealed []byte) error) error {
+	_, r, err := s.S.Read(s.ID, hashedKey)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	chunker := s.Chunking(r)
+	for i := 0; ; i++ {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if want != nil && !want(i) {
+			continue
+		}
+		c, sealed, err := sealChunk(activeKey, chunk)
+		if err != nil {
+			return err
+		}
+		if err := fn(i, c, sealed); err != nil {
+			return err
+		}
+	}
+}
+
+// replicateChunks sends this node's copy of the file stored under
+// hashedKey to peers chunk by chunk, followed by its encrypted manifest,
+// and waits until needed of them acknowledged it. Peers only receive the
+// chunks they do not hold yet, so files sharing data with earlier ones, and
+// transfers retried after a failure, only send what is missing. The file
+// is chunked once to build the manifest and once more to send the chunks,
+// however many peers receive it, and only a chunk at a time is held in
+// memory.
+func (s *FileServer) replicateChunks(key string, hashedKey string, stored time.Time, peers []p2p.Peer, needed int) error {
+	// All chunks of a file are sealed with the same key, even if it is
+	// rotated while the file is replicated.
+	activeKey := s.activeKey()
+
+	m := &manifest{}
+	err := s.eachChunk(hashedKey, activeKey, nil, func(_ int, c manifestChunk, _ []byte) error {
+		m.Size += int64(c.Size)
+		m.Chunks = append(m.Chunks, c)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// Every replica gets the same encrypted manifest, so their digests
+	// can be compared.
+	sealed := new(bytes.Buffer)
+	if _, err := gcrypto.CopyEncryptTo(bytes.NewReader(plain), sealed, s.recipients(key)...); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(sealed.Bytes())
+	digest := hex.EncodeToString(sum[:])
+
+	streams, errs := s.openStreams(peers, func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageStoreFile{
+				ID:       s.ID,
+				Key:      hashedKey,
+				Size:     int64(sealed.Len()),
+				StreamID: streamID,
+				Stored:   stored,
+				Chunks:   m.digests(),
+			},
+		}
+	})
+	if len(streams) < needed {
+		resetStreams(streams)
+		return fmt.Errorf("failed to send file to peers: %w: %d of %d peers reachable, %d needed: %w", ErrQuorum, len(streams), len(peers), needed, errors.Join(errs...))
+	}
+
+	fan := newFanout(streams, needed)
+	wants, errs := readWants(streams, len(m.Chunks))
+	for i, err := range errs {
+		if err != nil {
+			fan.fail(i, err)
+		}
+	}
+	done := make(chan struct{})
+	go fan.watch(done)
+	err = s.sendChunks(fan, hashedKey, activeKey, m, wants, sealed.Bytes())
+	close(done)
+	if err != nil {
+		resetStreams(streams)
+		return fmt.Errorf("failed to send file to peers: %w", err)
+	}
+
+	results := make(chan error, len(streams))
+	for i, stream := range streams {
+		if fan.errs[i] != nil {
+			results <- fan.errs[i]
+			continue
+		}
+		go func(stream p2p.Stream) {
+			err := readAck(stream, int64(sealed.Len()), digest)
+			if err != nil {
+				stream.Reset()
+				err = fmt.Errorf("stream %d: %w", stream.ID(), s.failure(stream, err))
+			}
+			results <- err
+		}(stream)
+	}
+
+	if _, err := waitQuorum(results, len(streams), needed); err != nil {
+		return fmt.Errorf("failed to send file to peers: %w", err)
+	}
+	return nil
+}
+
+// readWants reads from every stream the indexes of the chunks the peer on
+// the other end lacks, out of the n chunks of a file. Peers that do not
+// answer within storeStallTimeout are given up.
+func readWants(streams []p2p.Stream, n int) ([]map[int]bool, []error) {
+	wants := make([]map[int]bool, len(streams))
+	errs := make([]error, len(streams))
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(i int, stream p2p.Stream) {
+			defer wg.Done()
+			timer := time.AfterFunc(storeStallTimeout, func() { stream.Reset() })
+			defer timer.Stop()
+			wants[i], errs[i] = readWant(stream, n)
+		}(i, stream)
+	}
+	wg.Wait()
+	return wants, errs
+}
+
+func readWant(r io.Reader, n int) (map[int]bool, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if int(count) > n {
+		return nil, fmt.Errorf("peer asks for %d of %d chunks", count, n)
+	}
+	missing := make([]uint32, count)
+	if err := binary.Read(r, binary.LittleEndian, missing); err != nil {
+		return nil, err
+	}
+	want := make(map[int]bool, len(missing))
+	for _, i := range missing {
+		if int(i) >= n {
+			return nil, fmt.Errorf("peer asks for chunk %d of %d", i, n)
+		}
+		want[int(i)] = true
+	}
+	return want, nil
+}
+
+// sendChunks seals every chunk some peer of fan wants once and writes it to
+// those peers, followed by the encrypted manifest to all of them. wants
+// holds the chunks each stream of fan asked for.
+func (s *FileServer) sendChunks(fan *fanout, hashedKey string, activeKey []byte, m *manifest, wants []map[int]bool, sealedManifest []byte) error {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	wanted := func(i int) bool {
+		for j, want := range wants {
+			if fan.errs[j] == nil && want[i] {
+				return true
+			}
+		}
+		return false
+	}
+	err := s.eachChunk(hashedKey, activeKey, wanted, func(i int, c manifestChunk, sealed []byte) error {
+		if i >= len(m.Chunks) || c.Digest != m.Chunks[i].Digest {
+			return fmt.Errorf("file (%s) changed while it was replicated", hashedKey)
+		}
+		w := fanoutTo{fan, func(j int) bool { return wants[j][i] }}
+		return writeChunkFrame(w, sealed)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fan.Write(sealedManifest); err != nil {
+		return err
+	}
+
+	for i, stream := range fan.streams {
+		if fan.errs[i] == nil {
+			logger.Infof("sent (%d) of (%d) chunks on stream (%d)", len(wants[i]), len(m.Chunks), stream.ID())
+		}
+	}
+	return nil
+}
+
+// fanoutTo writes to the streams of a fanout that want returns true for.
+type fanoutTo struct {
+	fan  *fanout
+	want func(i int) bool
+}
+
+func (w fanoutTo) Write(p []byte) (int, error) {
+	return w.fan.writeTo(p, w.want)
+}
+
+func writeChunkFrame(w io.Writer, sealed []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(sealed))); err != nil {
+		return err
+	}
+	_, err := w.Write(sealed)
+	return err
+}
+
+func readChunkFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > maxChunkFrame {
+		return nil, fmt.Errorf("chunk of %d bytes exceeds the limit", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// receiveChunks stores the chunks of a file replicated with chunking that
+// this node lacks and the manifest that follows them.
+func (s *FileServer) receiveChunks(stream p2p.Stream, msg MessageStoreFile) (int64, error) {
+	var (
+		missing []uint32
+		seen    = make(map[string]bool)
+	)
+	for i, digest := range msg.Chunks {
+		if !seen[digest] && !s.S.HasChunk(digest) {
+			missing = append(missing, uint32(i))
+		}
+		seen[digest] = true
+	}
+	if err := binary.Write(stream, binary.LittleEndian, uint32(len(missing))); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(stream, binary.LittleEndian, missing); err != nil {
+		return 0, err
+	}
+
+	for _, i := range missing {
+		sealed, err := readChunkFrame(stream)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.S.WriteChunk(msg.Chunks[i], sealed); err != nil {
+			return 0, err
+		}
+	}
+	return s.S.WriteManifest(msg.ID, msg.Key, io.LimitReader(stream, msg.Size), msg.Size, msg.Chunks)
+}
+
+// openChunked returns the contents of a file replicated with chunking,
+// whose encrypted manifest r yields. Chunks are fetched from peer, or read
+// from this node's storage if peer is nil.
+func (s *FileServer) openChunked(r io.Reader, peer p2p.Peer, unwrappers ...gcrypto.Unwrapper) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	if _, err := gcrypto.CopyDecryptWith(r, buf, unwrappers...); err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(buf.Bytes(), m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	next := func(i int) ([]byte, error) {
+		return s.S.ReadChunk(m.Chunks[i].Digest)
+	}
+	var stream p2p.Stream
+	if peer != nil {
+		var err error
+		stream, err = s.openStream(peer, func(streamID uint32) *Message {
+			return &Message{Payload: MessageGetChunks{Digests: m.digests(), StreamID: streamID}}
+		})
+		if err != nil {
+			return nil, err
+		}
+		next = func(int) ([]byte, error) {
+			return readChunkFrame(stream)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := assembleChunks(m, next, pw)
+		if stream != nil {
+			if err != nil {
+				stream.Reset()
+			} else {
+				stream.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// assembleChunks writes the contents of the chunks of m, which next
+// returns sealed, to w.
+func assembleChunks(m *manifest, next func(i int) ([]byte, error), w io.Writer) error {
+	var n int64
+	for i, c := range m.Chunks {
+		sealed, err := next(i)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(sealed)
+		if hex.EncodeToString(sum[:]) != c.Digest {
+			return fmt.Errorf("chunk %d does not match its digest", i)
+		}
+		chunk, err := gcrypto.OpenConvergent(c.Key, sealed)
+		if err != nil {
+			return err
+		}
+		if len(chunk) != c.Size {
+			return fmt.Errorf("chunk %d has %d bytes instead of %d", i, len(chunk), c.Size)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n += int64(len(chunk))
+	}
+	if n != m.Size {
+		return fmt.Errorf("chunks add up to %d bytes instead of %d", n, m.Size)
+	}
+	return nil
+}
+
+func (s *FileServer) handleMessageGetChunks(from string, msg MessageGetChunks) error {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	s.serving.Add(1)
+	defer s.serving.Add(-1)
+
+	for _, digest := range msg.Digests {
+		sealed, err := s.S.ReadChunk(digest)
+		if err != nil {
+			stream.Reset()
+			return err
+		}
+		if err := writeChunkFrame(stream, sealed); err != nil {
+			stream.Reset()
+			return err
+		}
+	}
+
+	logger.Infof("served (%d) chunks to %s", len(msg.Digests), from)
+
+	return stream.Close()
+}
+
+// receiveChunked stores this node's own file under hashedKey, whose
+// encrypted manifest r yields, with the chunks fetched from peer.
+func (s *FileServer) receiveChunked(peer p2p.Peer, hashedKey string, r io.Reader) (int64, error) {
+	contents, err := s.openChunked(r, peer, gcrypto.KeyRingUnwrapper{KeyRing: s.KeyRing})
+	if err != nil {
+		return 0, err
+	}
+	return s.S.Write(s.ID, hashedKey, contents)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jekki/gdss/store"
+)
+
+func TestReplicateChunks(t *testing.T) {
+	var chunked atomic.Int32
+	chunking := func(r io.Reader) store.Chunker {
+		chunked.Add(1)
+		return store.FixedChunking(1024)(r)
+	}
+	a := newTestServer(t, FileServerOpts{Chunking: chunking})
+	b := newTestServer(t, FileServerOpts{})
+	c := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	connect(t, a, c)
+
+	data := make([]byte, 10*1024+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := a.Store("key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// Once for the manifest and once for the chunks sent to both peers.
+	if n := chunked.Load(); n != 2 {
+		t.Errorf("expected the file to be chunked twice, got %d", n)
+	}
+
+	hashedKey := a.hashKey("key")
+	for _, peer := range []*FileServer{b, c} {
+		if !peer.S.Has(a.ID, hashedKey) {
+			t.Errorf("expected a replica on %s", peer.ID)
+		}
+	}
+
+	// Without its own copy, a assembles the file from a replica's chunks.
+	if err := a.S.Delete(a.ID, hashedKey); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(got); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("got %d bytes: %v", len(b), err)
+	}
+}
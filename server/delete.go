@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+)
+
+// DefaultTombstoneGracePeriod is how long tombstones are kept by default.
+const DefaultTombstoneGracePeriod = 7 * 24 * time.Hour
+
+// MessageDeleteFile tells peers that node ID deleted the file stored under
+// Key at Deleted.
+type MessageDeleteFile struct {
+	ID      string
+	Key     string
+	Deleted time.Time
+}
+
+// MessageTombstones carries the deletions a node made to a peer that just
+// connected, so replicas that were offline catch up on them.
+type MessageTombstones struct {
+	Deletions []MessageDeleteFile
+}
+
+// Delete deletes key here and on every peer. A tombstone stays behind in
+// place of the file, which keeps replicas that missed the deletion from
+// bringing the file back until the tombstone is older than
+// TombstoneGracePeriod. Deletions are ordered by wall clock time, so node
+// clocks should be kept in sync.
+//
+// Delete only fails if the file cannot be buried here. Peers that miss the
+// deletion are logged and catch up on the tombstone once they connect
+// again, so they do not fail a deletion that will converge.
+func (s *FileServer) Delete(key string) error {
+	hashedKey := s.hashKey(key)
+	now := time.Now().UTC()
+
+	if err := s.S.Bury(s.ID, hashedKey, now); err != nil {
+		return err
+	}
+	s.forgetHolders(dhtKey(s.ID, hashedKey))
+
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	logger.Infof("deleted file (%s), notifying peers", key)
+
+	deletion := MessageDeleteFile{
+		ID:      s.ID,
+		Key:     hashedKey,
+		Deleted: now,
+	}
+	var pending []*call
+	for _, peer := range s.connectedPeers() {
+		cl, err := s.request(peer, &Message{Payload: deletion})
+		if err != nil {
+			logger.Warnf("notifying %s of the deletion: %v", peerKey(peer), err)
+			continue
+		}
+		pending = append(pending, cl)
+	}
+	for _, cl := range pending {
+		if err := s.wait(cl, requestTimeout); err != nil {
+			logger.Warnf("notifying %s of the deletion: %v", cl.peer, err)
+		}
+	}
+	return nil
+}
+
+// sendTombstones tells peer about the deletions this node made.
+func (s *FileServer) sendTombstones(peer p2p.Peer) {
+	tombstones, err := s.S.Tombstones(s.ID)
+	if err != nil || len(tombstones) == 0 {
+		return
+	}
+
+	msg := MessageTombstones{}
+	for _, t := range tombstones {
+		msg.Deletions = append(msg.Deletions, MessageDeleteFile{ID: t.ID, Key: t.Key, Deleted: t.Deleted})
+	}
+	if err := s.send(peer, &Message{Payload: msg}); err != nil {
+		logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+		logger.Warnf("sending tombstones to %s: %v", peer.RemoteAddr(), err)
+	}
+}
+
+// collectTombstones removes expired tombstones, and blobs and chunks no
+// file refers to anymore, until the server stops.
+func (s *FileServer) collectTombstones() {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	interval := time.Hour
+	if s.TombstoneGracePeriod < interval {
+		interval = s.TombstoneGracePeriod
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.S.CollectTombstones(s.TombstoneGracePeriod)
+			if err != nil {
+				logger.Warnf("collecting tombstones: %v", err)
+			} else if n > 0 {
+				logger.Infof("collected (%d) expired tombstones", n)
+			}
+			n, err = s.S.PruneBlobs()
+			if err != nil {
+				logger.Warnf("pruning blobs: %v", err)
+			} else if n > 0 {
+				logger.Infof("pruned (%d) unused blobs and chunks", n)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// applyDeletion buries the file of a deletion issued by from. Only the
+// owner of a file may delete it.
+func (s *FileServer) applyDeletion(from string, msg MessageDeleteFile) error {
+	if msg.ID != from {
+		return fmt.Errorf("peer (%s) may not delete files of %s", from, msg.ID)
+	}
+	if time.Since(msg.Deleted) > s.TombstoneGracePeriod {
+		return nil
+	}
+	s.forgetHolders(dhtKey(msg.ID, msg.Key))
+	return s.S.Bury(msg.ID, msg.Key, msg.Deleted)
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	if err := s.applyDeletion(from, msg); err != nil {
+		return err
+	}
+
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	logger.Infof("deleted file (%s) of %s", msg.Key, msg.ID)
+	return nil
+}
+
+func (s *FileServer) handleMessageTombstones(from string, msg MessageTombstones) error {
+	for _, d := range msg.Deletions {
+		if err := s.applyDeletion(from, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
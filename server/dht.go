@@ -0,0 +1,426 @@
+package server
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/jekki/gdss/dht"
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+)
+
+// holderRecordTTL is how long a node remembers who holds a file, unless the
+// record is stored again.
+const holderRecordTTL = 24 * time.Hour
+
+// dhtTimeout bounds connecting to a node and waiting for its answer during
+// a lookup.
+var dhtTimeout = 5 * time.Second
+
+// dialedIdleTimeout is how long a connection dialed to reach a contact stays
+// open without being used.
+var dialedIdleTimeout = time.Minute
+
+// maxDialed bounds how many connections dialed to reach contacts stay open.
+const maxDialed = dht.DefaultK
+
+// MessageFindNode asks a peer for the contacts it knows closest to Target,
+// written back as a dhtResponse on the stream StreamID.
+type MessageFindNode struct {
+	Target   dht.ID
+	StreamID uint32
+}
+
+// MessageFindValue is MessageFindNode for the file under Key: a peer that
+// knows who holds it answers with them as well.
+type MessageFindValue struct {
+	Key      dht.ID
+	StreamID uint32
+}
+
+// MessageStoreValue asks a peer to remember that the sender holds the file
+// under Key.
+type MessageStoreValue struct {
+	Key dht.ID
+}
+
+// dhtResponse is what a peer writes back for MessageFindNode and
+// MessageFindValue.
+type dhtResponse struct {
+	Contacts []dht.Contact
+	Holders  []dht.Contact
+}
+
+// holderRecord is a node known to hold a file.
+type holderRecord struct {
+	dht.Contact
+	expires time.Time
+}
+
+// dhtKey returns the ID the file node id stored under hashedKey is looked
+// up by.
+func dhtKey(id string, hashedKey string) dht.ID {
+	return dht.HashID(id + "/" + hashedKey)
+}
+
+// peerContact returns the contact of p. Nodes listening on all interfaces
+// are reached at the address they connected from.
+func peerContact(p p2p.Peer) dht.Contact {
+	info := p.Info()
+	c := dht.Contact{Node: info.ID, Addr: info.ListenAddr}
+	if len(c.Node) == 0 {
+		c.Node = p.RemoteAddr().String()
+	}
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		c.Addr = p.RemoteAddr().String()
+		return c
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		if remote, _, err := net.SplitHostPort(p.RemoteAddr().String()); err == nil {
+			c.Addr = net.JoinHostPort(remote, port)
+		}
+	}
+	return c
+}
+
+// addContact records that the node on the other end of p was seen. When its
+// bucket is full, the least recently seen contact is kept unless it does
+// not answer anymore.
+func (s *FileServer) addContact(p p2p.Peer) {
+	c := peerContact(p)
+	oldest, full := s.routes.Update(c)
+	if !full {
+		return
+	}
+	go func() {
+		_, err := s.queryNode(oldest, func(streamID uint32) *Message {
+			return &Message{Payload: MessageFindNode{Target: oldest.ID(), StreamID: streamID}}
+		})
+		if err != nil {
+			s.routes.Remove(oldest.Node)
+			s.routes.Update(c)
+		}
+	}()
+}
+
+// connect returns the connected peer of c, dialing it first if needed.
+// Connections it dials are only kept while they are used, see closeDialed.
+func (s *FileServer) connect(c dht.Contact) (p2p.Peer, error) {
+	if peer, ok := s.peer(c.Node); ok {
+		s.useDialed(c.Node, false)
+		return peer, nil
+	}
+	if c.Node == s.ID {
+		return nil, fmt.Errorf("contact (%s) is this node", c.Node)
+	}
+	if err := s.Transport.Dial(c.Addr); err != nil {
+		return nil, err
+	}
+
+	// The peer is registered once its handshake is done.
+	deadline := time.Now().Add(dhtTimeout)
+	for time.Now().Before(deadline) {
+		if peer, ok := s.peer(c.Node); ok {
+			s.useDialed(c.Node, true)
+			s.closeDialed(time.Time{})
+			return peer, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timeout while connecting to (%s) at %s", c.Node, c.Addr)
+}
+
+// useDialed records that the connection to node was used now. Only
+// connections connect dialed are tracked, added is set when it just did.
+func (s *FileServer) useDialed(node string, added bool) {
+	s.dialLock.Lock()
+	defer s.dialLock.Unlock()
+	if _, ok := s.dialed[node]; ok || added {
+		s.dialed[node] = time.Now()
+	}
+}
+
+// closeDialed closes the connections connect dialed that were last used
+// before idleSince, along with as many least recently used ones as it takes
+// to keep maxDialed open, so that looking nodes up does not leave this node
+// connected to every node it asked. Connections with streams open are in
+// use and stay.
+func (s *FileServer) closeDialed(idleSince time.Time) {
+	s.dialLock.Lock()
+	nodes := make([]string, 0, len(s.dialed))
+	for node := range s.dialed {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return s.dialed[nodes[i]].Before(s.dialed[nodes[j]]) })
+
+	var idle []p2p.Peer
+	excess := len(nodes) - maxDialed
+	for i, node := range nodes {
+		if i >= excess && !s.dialed[node].Before(idleSince) {
+			break
+		}
+		peer, ok := s.peer(node)
+		if !ok || !peer.Outbound() {
+			// The node dialed this one in the meantime, it keeps the
+			// connection open.
+			delete(s.dialed, node)
+			continue
+		}
+		if peer.Streams() > 0 {
+			continue
+		}
+		delete(s.dialed, node)
+		idle = append(idle, peer)
+	}
+	s.dialLock.Unlock()
+
+	for _, peer := range idle {
+		peer.Close()
+	}
+}
+
+// closeIdlePeers closes the connections connect dialed once they were not
+// used for dialedIdleTimeout, until the server stops.
+func (s *FileServer) closeIdlePeers() {
+	ticker := time.NewTicker(dialedIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.closeDialed(time.Now().Add(-dialedIdleTimeout))
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// forgetPeer drops what this node knows of a peer whose connection ended
+// with err. A node that hung up, e.g. because the connection was idle,
+// stays a contact of the routing table; one whose connection broke does
+// not.
+func (s *FileServer) forgetPeer(node string, err error) {
+	s.dialLock.Lock()
+	delete(s.dialed, node)
+	s.dialLock.Unlock()
+
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		s.routes.Remove(node)
+	}
+}
+
+// queryNode sends the message built by newMsg to c and reads its answer.
+func (s *FileServer) queryNode(c dht.Contact, newMsg func(streamID uint32) *Message) (dhtResponse, error) {
+	peer, err := s.connect(c)
+	if err != nil {
+		// Contacts that cannot be reached anymore are dropped.
+		s.routes.Remove(c.Node)
+		return dhtResponse{}, err
+	}
+	stream, err := s.openStream(peer, newMsg)
+	if err != nil {
+		return dhtResponse{}, err
+	}
+	timer := time.AfterFunc(dhtTimeout, func() { stream.Reset() })
+	defer timer.Stop()
+
+	var resp dhtResponse
+	if err := gob.NewDecoder(stream).Decode(&resp); err != nil {
+		stream.Reset()
+		return dhtResponse{}, s.failure(stream, err)
+	}
+	stream.Close()
+	return resp, nil
+}
+
+// joinNetwork fills the routing table by looking up this node, which asks
+// the nodes around it for their neighbours.
+func (s *FileServer) joinNetwork() {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	// Bootstrap nodes are dialed in the background.
+	deadline := time.Now().Add(dhtTimeout)
+	for s.routes.Len() == 0 {
+		if time.Now().After(deadline) {
+			logger.Warnf("no bootstrap node connected, not joining the network")
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	nodes := s.findNodes(dht.HashID(s.ID))
+	logger.Infof("joined the network with (%d) neighbours, (%d) contacts known", len(nodes), s.routes.Len())
+}
+
+// findNodes returns the nodes of the network closest to target.
+func (s *FileServer) findNodes(target dht.ID) []dht.Contact {
+	return s.routes.Lookup(target, dht.DefaultAlpha, func(c dht.Contact) ([]dht.Contact, bool, error) {
+		resp, err := s.queryNode(c, func(streamID uint32) *Message {
+			return &Message{Payload: MessageFindNode{Target: target, StreamID: streamID}}
+		})
+		return resp.Contacts, false, err
+	})
+}
+
+// findHolders returns the nodes known to hold the file node id stored under
+// hashedKey, looking them up in the network unless this node knows them.
+func (s *FileServer) findHolders(id string, hashedKey string) []dht.Contact {
+	key := dhtKey(id, hashedKey)
+	if holders := s.holders(key); len(holders) > 0 {
+		return holders
+	}
+
+	var holders []dht.Contact
+	s.routes.Lookup(key, dht.DefaultAlpha, func(c dht.Contact) ([]dht.Contact, bool, error) {
+		resp, err := s.queryNode(c, func(streamID uint32) *Message {
+			return &Message{Payload: MessageFindValue{Key: key, StreamID: streamID}}
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if len(resp.Holders) > 0 {
+			holders = resp.Holders
+			return nil, true, nil
+		}
+		return resp.Contacts, false, nil
+	})
+	return holders
+}
+
+// holderPeers connects to the nodes holding the file node id stored under
+// hashedKey, other than this one.
+func (s *FileServer) holderPeers(id string, hashedKey string) []p2p.Peer {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	var peers []p2p.Peer
+	for _, c := range s.findHolders(id, hashedKey) {
+		if c.Node == s.ID {
+			continue
+		}
+		peer, err := s.connect(c)
+		if err != nil {
+			logger.Warnf("connecting to holder (%s): %v", c.Node, err)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// announce records that this node holds the file node id stored under
+// hashedKey on the nodes closest to its key, so that nodes that are not
+// connected to it find it. Nodes only take a holder's own word for it, so
+// every holder announces itself; peers are the holders this node sent the
+// file to, which it records for itself.
+func (s *FileServer) announce(id string, hashedKey string, peers []p2p.Peer) {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	key := dhtKey(id, hashedKey)
+	holders := []dht.Contact{{Node: s.ID, Addr: s.Transport.Addr()}}
+	for _, peer := range peers {
+		holders = append(holders, peerContact(peer))
+	}
+	s.storeHolders(key, holders)
+
+	for _, c := range s.findNodes(key) {
+		peer, err := s.connect(c)
+		if err == nil {
+			err = s.send(peer, &Message{Payload: MessageStoreValue{Key: key}})
+		}
+		if err != nil {
+			logger.Warnf("announcing file (%s) to (%s): %v", hashedKey, c.Node, err)
+		}
+	}
+}
+
+// holders returns the unexpired holders recorded for key.
+func (s *FileServer) holders(key dht.ID) []dht.Contact {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+
+	var holders []dht.Contact
+	for node, r := range s.records[key] {
+		if time.Now().After(r.expires) {
+			delete(s.records[key], node)
+			continue
+		}
+		holders = append(holders, r.Contact)
+	}
+	if len(s.records[key]) == 0 {
+		delete(s.records, key)
+	}
+	return holders
+}
+
+func (s *FileServer) storeHolders(key dht.ID, holders []dht.Contact) {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+
+	records, ok := s.records[key]
+	if !ok {
+		records = make(map[string]holderRecord)
+		s.records[key] = records
+	}
+	expires := time.Now().Add(holderRecordTTL)
+	for _, c := range holders {
+		records[c.Node] = holderRecord{Contact: c, expires: expires}
+	}
+}
+
+// forgetHolders drops the records of key, e.g. once the file was deleted.
+func (s *FileServer) forgetHolders(key dht.ID) {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	delete(s.records, key)
+}
+
+func (s *FileServer) handleMessageFindNode(from string, msg MessageFindNode) error {
+	return s.answerLookup(from, msg.StreamID, msg.Target, nil)
+}
+
+func (s *FileServer) handleMessageFindValue(from string, msg MessageFindValue) error {
+	return s.answerLookup(from, msg.StreamID, msg.Key, s.holders(msg.Key))
+}
+
+// answerLookup writes back the contacts closest to target, leaving out the
+// asking peer, along with holders.
+func (s *FileServer) answerLookup(from string, streamID uint32, target dht.ID, holders []dht.Contact) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	stream, err := peer.AcceptStream(streamID)
+	if err != nil {
+		return err
+	}
+
+	resp := dhtResponse{Holders: holders}
+	for _, c := range s.routes.Closest(target, dht.DefaultK+1) {
+		if c.Node != from && len(resp.Contacts) < dht.DefaultK {
+			resp.Contacts = append(resp.Contacts, c)
+		}
+	}
+	if err := gob.NewEncoder(stream).Encode(resp); err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
+
+func (s *FileServer) handleMessageStoreValue(from string, msg MessageStoreValue) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	// Any node could claim others hold a file, so only the sender is
+	// recorded, at the address it is reached at.
+	s.storeHolders(msg.Key, []dht.Contact{peerContact(peer)})
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/dht"
+)
+
+// hasContact reports whether contacts holds node.
+func hasContact(contacts []dht.Contact, node string) bool {
+	for _, c := range contacts {
+		if c.Node == node {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFindNode(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	c := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	connect(t, b, c)
+
+	// a only learns of c from b.
+	if !hasContact(a.findNodes(dht.HashID(c.ID)), c.ID) {
+		t.Fatal("expected the lookup to find c")
+	}
+	if _, ok := a.peer(c.ID); !ok {
+		t.Fatal("expected a to have dialed c")
+	}
+
+	// The connection is closed once idle, c stays a contact.
+	a.closeDialed(time.Now())
+	eventually(t, func() bool {
+		_, ok := a.peer(c.ID)
+		return !ok
+	})
+	if !hasContact(a.routes.Closest(dht.HashID(c.ID), 1), c.ID) {
+		t.Error("expected c to stay a contact")
+	}
+	// Connections a did not dial for a lookup stay open.
+	if _, ok := a.peer(b.ID); !ok {
+		t.Error("expected the connection to b to stay open")
+	}
+}
+
+func TestFindValue(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	c := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	connect(t, b, c)
+
+	if err := a.Store("key", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	hashedKey := a.hashKey("key")
+
+	// Owner and replica announced themselves to every node around the key,
+	// c included.
+	key := dhtKey(a.ID, hashedKey)
+	eventually(t, func() bool {
+		holders := c.holders(key)
+		return hasContact(holders, a.ID) && hasContact(holders, b.ID)
+	})
+
+	// A node that knows neither holder finds them through c.
+	d := newTestServer(t, FileServerOpts{})
+	connect(t, d, c)
+	holders := d.findHolders(a.ID, hashedKey)
+	if !hasContact(holders, a.ID) || !hasContact(holders, b.ID) {
+		t.Errorf("expected a and b to hold the file, got %v", holders)
+	}
+	if len(d.holderPeers(a.ID, hashedKey)) != 2 {
+		t.Error("expected to connect to both holders")
+	}
+}
+
+func TestStoreValueRecordsSender(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+
+	key := dht.HashID("key")
+	if err := a.handleMessageStoreValue(b.ID, MessageStoreValue{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	holders := a.holders(key)
+	if len(holders) != 1 || holders[0].Node != b.ID || holders[0].Addr != b.Transport.Addr() {
+		t.Errorf("expected b to be recorded, got %v", holders)
+	}
+
+	// Nodes that are not connected cannot claim anything.
+	if err := a.handleMessageStoreValue("unknown", MessageStoreValue{Key: key}); err == nil {
+		t.Error("expected a message of an unknown peer to fail")
+	}
+}
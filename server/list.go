@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+	"github.com/jekki/gdss/store"
+)
+
+// maxListLimit caps the page size of List, locally and on peers.
+const maxListLimit = 1000
+
+// MessageListFiles asks a peer for a page of the files it holds for node ID,
+// to be written back on the stream StreamID.
+type MessageListFiles struct {
+	ID       string
+	Prefix   string
+	Cursor   string
+	Limit    int
+	StreamID uint32
+}
+
+// listResponse is what a peer writes back for MessageListFiles.
+type listResponse struct {
+	Node string
+	Page store.ListPage
+}
+
+// ListEntry is a file found by List along with the nodes holding it.
+type ListEntry struct {
+	store.FileInfo
+	Nodes []string
+}
+
+// ListResult is one page of List results.
+type ListResult struct {
+	Entries []ListEntry
+	// Next is the cursor of the following page, empty on the last one.
+	Next string
+}
+
+// List returns the files stored for node id whose name starts with prefix,
+// see store.Store.List. Files are stored under the hash of their key and
+// named after it by the node that stored them, so prefixes of keys only
+// select among that node's files; replicas are named by the hash. With
+// fanOut set, the pages of all peers are merged in; peers that do not
+// answer in time are left out.
+func (s *FileServer) List(id string, prefix string, cursor string, limit int, fanOut bool) (ListResult, error) {
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	local, err := s.S.List(id, prefix, cursor, limit)
+	if err != nil {
+		return ListResult{}, err
+	}
+	pages := []listResponse{{Node: s.ID, Page: local}}
+
+	if fanOut {
+		pages = append(pages, s.listPeers(id, prefix, cursor, limit)...)
+	}
+	return mergeListPages(pages, limit), nil
+}
+
+func (s *FileServer) listPeers(id string, prefix string, cursor string, limit int) []listResponse {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	streams, errs := s.openStreams(s.connectedPeers(), func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageListFiles{
+				ID:       id,
+				Prefix:   prefix,
+				Cursor:   cursor,
+				Limit:    limit,
+				StreamID: streamID,
+			},
+		}
+	})
+	for _, err := range errs {
+		logger.Warnf("listing files on peer: %v", err)
+	}
+
+	responseCh := make(chan listResponse, len(streams))
+	errCh := make(chan error, len(streams))
+	for _, stream := range streams {
+		go func(stream p2p.Stream) {
+			var resp listResponse
+			if err := gob.NewDecoder(stream).Decode(&resp); err != nil {
+				errCh <- fmt.Errorf("stream %d: %w", stream.ID(), s.failure(stream, err))
+				return
+			}
+			stream.Close()
+			responseCh <- resp
+		}(stream)
+	}
+
+	timeout := time.After(time.Second * 5)
+	var pages []listResponse
+	for range streams {
+		select {
+		case resp := <-responseCh:
+			pages = append(pages, resp)
+		case err := <-errCh:
+			logger.Warnf("listing files on peer: %v", err)
+		case <-timeout:
+			logger.Warnf("timeout while waiting for file listings from peers")
+			resetStreams(streams)
+			return pages
+		}
+	}
+	return pages
+}
+
+// mergeListPages merges the pages nodes returned for the same request into
+// one page of at most limit entries.
+func mergeListPages(pages []listResponse, limit int) ListResult {
+	var (
+		entries = make(map[string]*ListEntry)
+		more    bool
+	)
+	for _, resp := range pages {
+		if len(resp.Page.Next) > 0 {
+			more = true
+		}
+		for _, fi := range resp.Page.Files {
+			// Replicas of a file are stored at the same path, but only the
+			// owner knows its name.
+			k := fi.ID + "/" + fi.Path
+			e, ok := entries[k]
+			if !ok {
+				e = &ListEntry{FileInfo: fi}
+				entries[k] = e
+			} else if _, named := fi.Attrs[store.NameAttr]; named {
+				e.FileInfo = fi
+			}
+			e.Nodes = append(e.Nodes, resp.Node)
+		}
+	}
+
+	var result ListResult
+	for _, e := range entries {
+		result.Entries = append(result.Entries, *e)
+	}
+	// Same order as store.Store.List.
+	sort.Slice(result.Entries, func(i, j int) bool {
+		a, b := result.Entries[i], result.Entries[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if a.Name() != b.Name() {
+			return a.Name() < b.Name()
+		}
+		return a.Path < b.Path
+	})
+	if len(result.Entries) > limit {
+		result.Entries = result.Entries[:limit]
+		more = true
+	}
+	if more && len(result.Entries) > 0 {
+		result.Next = store.ListCursor(result.Entries[len(result.Entries)-1].FileInfo)
+	}
+	return result
+}
+
+func (s *FileServer) handleMessageListFiles(from string, msg MessageListFiles) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	limit := msg.Limit
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	page, err := s.S.List(msg.ID, msg.Prefix, msg.Cursor, limit)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+
+	if err := gob.NewEncoder(stream).Encode(listResponse{Node: s.ID, Page: page}); err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
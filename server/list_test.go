@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/jekki/gdss/p2p"
+)
+
+func TestListByName(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		EncKey:      make([]byte, 32),
+		StorageRoot: t.TempDir(),
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddress: "127.0.0.1:0"}),
+	})
+
+	for _, key := range []string{"photos/b.png", "docs/a.txt", "photos/a.png"} {
+		if err := s.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files are stored under the hash of their key but listed by it.
+	var names []string
+	cursor := ""
+	for {
+		result, err := s.List(s.ID, "photos/", cursor, 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range result.Entries {
+			names = append(names, e.Name())
+		}
+		if len(result.Next) == 0 {
+			break
+		}
+		cursor = result.Next
+	}
+
+	want := []string{"photos/a.png", "photos/b.png"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("want %v have %v", want, names)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+)
+
+// probeTimeout bounds how long probing peers for a file and waiting for the
+// header of a file to fetch may take.
+var probeTimeout = 5 * time.Second
+
+// MessageHasFile asks a peer whether it holds the file node ID stored under
+// Key, to be answered with a hasReply on the stream StreamID. Peers that do
+// not hold it answer StatusNotFound.
+type MessageHasFile struct {
+	ID       string
+	Key      string
+	StreamID uint32
+}
+
+// hasReply describes the copy of a file a peer holds.
+type hasReply struct {
+	fileHeader
+	// Load is how many transfers the peer is serving.
+	Load int64
+}
+
+// holder is a peer found holding a file.
+type holder struct {
+	peer  p2p.Peer
+	reply hasReply
+	// rtt is how long the peer took to answer the probe.
+	rtt time.Duration
+}
+
+// probe asks peers whether they hold the file node id stored under
+// hashedKey, each one on its own, so that peers that fail or are slow to
+// answer do not hold up the others. It returns as soon as needed of them
+// answered that they do, along with any other holder that answered by then,
+// or fails with ErrQuorum once too few can still answer.
+func (s *FileServer) probe(peers []p2p.Peer, id string, hashedKey string, needed int) ([]holder, error) {
+	if needed == 0 {
+		return nil, fmt.Errorf("no peer to fetch file (%s) from", hashedKey)
+	}
+
+	type answer struct {
+		holder
+		err error
+	}
+	start := time.Now()
+	answers := make(chan answer, len(peers))
+	for _, peer := range peers {
+		go func(peer p2p.Peer) {
+			reply, err := s.probeHolder(peer, id, hashedKey)
+			answers <- answer{holder{peer, reply, time.Since(start)}, err}
+		}(peer)
+	}
+
+	var (
+		timeout = time.After(probeTimeout)
+		holders []holder
+		errs    []error
+	)
+	add := func(a answer) {
+		if a.err != nil {
+			errs = append(errs, a.err)
+		} else {
+			holders = append(holders, a.holder)
+		}
+	}
+	for len(holders) < needed {
+		if len(peers)-len(errs) < needed {
+			return nil, fmt.Errorf("%w: %d of %d peers hold file (%s), %d needed: %w", ErrQuorum, len(holders), len(peers), hashedKey, needed, errors.Join(errs...))
+		}
+		select {
+		case a := <-answers:
+			add(a)
+		case <-timeout:
+			return nil, fmt.Errorf("%w: timeout while probing peers for file (%s), %d of %d hold it, %d needed", ErrQuorum, hashedKey, len(holders), len(peers), needed)
+		}
+	}
+	for {
+		select {
+		case a := <-answers:
+			add(a)
+		default:
+			return holders, nil
+		}
+	}
+}
+
+// probeHolder asks peer whether it holds the file node id stored under
+// hashedKey and returns its reply.
+func (s *FileServer) probeHolder(peer p2p.Peer, id string, hashedKey string) (hasReply, error) {
+	stream, err := s.openStream(peer, func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageHasFile{
+				ID:       id,
+				Key:      hashedKey,
+				StreamID: streamID,
+			},
+		}
+	})
+	if err != nil {
+		return hasReply{}, fmt.Errorf("peer (%s): %w", peerKey(peer), err)
+	}
+	timer := time.AfterFunc(probeTimeout, func() { stream.Reset() })
+	defer timer.Stop()
+
+	var reply hasReply
+	if err := binary.Read(stream, binary.LittleEndian, &reply); err != nil {
+		stream.Reset()
+		return hasReply{}, fmt.Errorf("peer (%s): %w", peerKey(peer), s.failure(stream, err))
+	}
+	stream.Close()
+	return reply, nil
+}
+
+// rankHolders orders the holders of the newest copy of a file by how soon
+// they are likely to serve it: least loaded first, then fastest to answer.
+// Holders of other copies are left out.
+func (s *FileServer) rankHolders(holders []holder, hashedKey string) []holder {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	newest := holders[0].reply
+	for _, h := range holders[1:] {
+		if h.reply.Stored > newest.Stored {
+			newest = h.reply
+		}
+	}
+
+	var ranked []holder
+	for _, h := range holders {
+		if h.reply.Digest != newest.Digest {
+			logger.Warnf("peer (%s) holds an older copy of file (%s)", peerKey(h.peer), hashedKey)
+			continue
+		}
+		ranked = append(ranked, h)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].reply.Load != ranked[j].reply.Load {
+			return ranked[i].reply.Load < ranked[j].reply.Load
+		}
+		return ranked[i].rtt < ranked[j].rtt
+	})
+	return ranked
+}
+
+// openFile asks h for the file node id stored under hashedKey and returns
+// the stream it follows on along with its header.
+func (s *FileServer) openFile(h holder, id string, hashedKey string) (p2p.Stream, fileHeader, error) {
+	stream, err := s.openStream(h.peer, func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageGetFile{
+				ID:       id,
+				Key:      hashedKey,
+				StreamID: streamID,
+			},
+		}
+	})
+	if err != nil {
+		return nil, fileHeader{}, err
+	}
+	timer := time.AfterFunc(probeTimeout, func() { stream.Reset() })
+	defer timer.Stop()
+
+	var header fileHeader
+	if err := binary.Read(stream, binary.LittleEndian, &header); err != nil {
+		stream.Reset()
+		return nil, fileHeader{}, s.failure(stream, err)
+	}
+	if header.Digest != h.reply.Digest {
+		stream.Reset()
+		return nil, fileHeader{}, fmt.Errorf("file (%s) changed since it was probed", hashedKey)
+	}
+	return stream, header, nil
+}
+
+func (s *FileServer) handleMessageHasFile(from string, msg MessageHasFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	if !s.S.Has(msg.ID, msg.Key) {
+		stream.Reset()
+		return fmt.Errorf("%w: file (%s) of %s", ErrNotFound, msg.Key, msg.ID)
+	}
+	fi, err := s.S.Stat(msg.ID, msg.Key)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	reply := hasReply{fileHeader: fileHeaderOf(fi), Load: s.serving.Load()}
+	if err := binary.Write(stream, binary.LittleEndian, reply); err != nil {
+		stream.Reset()
+		return err
+	}
+	return stream.Close()
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/p2p"
+)
+
+// namedPeer is a peer known only by its node ID.
+type namedPeer struct {
+	p2p.Peer
+	id string
+}
+
+func (p namedPeer) Info() p2p.PeerInfo { return p2p.PeerInfo{ID: p.id} }
+
+func TestRankHolders(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		EncKey:      make([]byte, 32),
+		StorageRoot: t.TempDir(),
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddress: "127.0.0.1:0"}),
+	})
+
+	reply := func(digest byte, stored int64, load int64) hasReply {
+		r := hasReply{Load: load}
+		r.Digest[0] = digest
+		r.Stored = stored
+		return r
+	}
+	holders := []holder{
+		{namedPeer{id: "old"}, reply(1, 1, 0), time.Millisecond},
+		{namedPeer{id: "busy"}, reply(2, 2, 5), time.Millisecond},
+		{namedPeer{id: "slow"}, reply(2, 2, 1), 3 * time.Millisecond},
+		{namedPeer{id: "fast"}, reply(2, 2, 1), 2 * time.Millisecond},
+	}
+
+	// Holders of the older copy are left out, the others are ordered by
+	// load, then by how fast they answered.
+	var got []string
+	for _, h := range s.rankHolders(holders, "key") {
+		got = append(got, peerKey(h.peer))
+	}
+	want := []string{"fast", "slow", "busy"}
+	if len(got) != len(want) {
+		t.Fatalf("want %v have %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v have %v", want, got)
+		}
+	}
+}
+
+func TestProbeSkipsDeadHolder(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	if err := a.Store("key", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	hashedKey := a.hashKey("key")
+	peer, _ := a.peer(b.ID)
+
+	// A holder that cannot be asked does not keep the others from answering.
+	holders, err := a.probe([]p2p.Peer{deadPeer{}, peer}, a.ID, hashedKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 1 || peerKey(holders[0].peer) != b.ID {
+		t.Fatalf("expected b to hold the file, got %v", holders)
+	}
+
+	// Fetching falls over to the next holder once one fails.
+	dead := holder{peer: deadPeer{}, reply: holders[0].reply}
+	if err := a.S.Delete(a.ID, hashedKey); err != nil {
+		t.Fatal(err)
+	}
+	r, err := a.fetchFrom([]holder{dead, holders[0]}, hashedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "data" {
+		t.Errorf("got %q: %v", got, err)
+	}
+
+	// Without any holder left to serve it, fetching fails.
+	if _, err := a.fetchFrom([]holder{dead}, hashedKey); err == nil {
+		t.Error("expected fetching from a dead holder to fail")
+	}
+}
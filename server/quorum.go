@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jekki/gdss/p2p"
+)
+
+// Consistency is how many of the nodes holding a file a request waits for.
+type Consistency int
+
+const (
+	// ConsistencyDefault stands for the level configured in
+	// FileServerOpts.
+	ConsistencyDefault Consistency = iota
+	// ConsistencyOne waits for a single node.
+	ConsistencyOne
+	// ConsistencyQuorum waits for a majority of the nodes.
+	ConsistencyQuorum
+	// ConsistencyAll waits for every node.
+	ConsistencyAll
+)
+
+// ParseConsistency parses "one", "quorum" or "all". An empty string is
+// ConsistencyDefault.
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return ConsistencyDefault, nil
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("unknown consistency level %q", s)
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return "default"
+}
+
+// required returns how many of n nodes a request has to hear from.
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyOne:
+		if n > 0 {
+			return 1
+		}
+		return 0
+	case ConsistencyQuorum:
+		return n/2 + 1
+	}
+	return n
+}
+
+// ErrQuorum is returned when fewer nodes than a consistency level requires
+// answered a request.
+var ErrQuorum = errors.New("not enough replicas answered")
+
+// ErrInsufficientReplicas is returned when fewer of the nodes holding a
+// file are connected than a consistency level requires, so a request is
+// not even attempted.
+var ErrInsufficientReplicas = errors.New("insufficient replicas")
+
+// replicaCount returns how many nodes hold each file, the owner included:
+// ReplicationFactor, or this node and every peer if that is not positive.
+func (s *FileServer) replicaCount() int {
+	if s.ReplicationFactor <= 0 {
+		return len(s.connectedPeers()) + 1
+	}
+	return s.ReplicationFactor
+}
+
+// peersNeeded returns how many of the peers holding a file have to answer a
+// request at level, with this node answering as one of the replicaCount
+// nodes. It fails with ErrInsufficientReplicas if fewer than that are among
+// the connected peers.
+func (s *FileServer) peersNeeded(level Consistency, connected int) (int, error) {
+	n := s.replicaCount()
+	needed := level.required(n) - 1
+	if needed > connected {
+		return 0, fmt.Errorf("%w: %d of %d nodes connected, %d needed", ErrInsufficientReplicas, connected+1, n, needed+1)
+	}
+	return needed, nil
+}
+
+// storeAck is what a replica writes back once it stored a file.
+type storeAck struct {
+	// Size and Digest describe the bytes the replica stored, see
+	// store.FileInfo.
+	Size   int64
+	Digest string
+}
+
+// readAck closes this side of stream and waits for the replica on the
+// other end to acknowledge that it stored size bytes with digest.
+func readAck(stream p2p.Stream, size int64, digest string) error {
+	stream.Close()
+	timer := time.AfterFunc(storeStallTimeout, func() { stream.Reset() })
+	defer timer.Stop()
+
+	var ack storeAck
+	if err := gob.NewDecoder(stream).Decode(&ack); err != nil {
+		return err
+	}
+	if ack.Size != size || ack.Digest != digest {
+		return fmt.Errorf("replica stored %d bytes with digest %s, sent %d bytes with digest %s", ack.Size, ack.Digest, size, digest)
+	}
+	return nil
+}
+
+// waitQuorum reads the outcome of n replicas from results until needed of
+// them succeeded, and returns how many did. It fails with ErrQuorum as soon
+// as too many failed to reach needed. Outcomes that arrive afterwards are
+// dropped, so results has to be buffered for n.
+func waitQuorum(results <-chan error, n int, needed int) (int, error) {
+	var (
+		acked int
+		errs  []error
+	)
+	for acked < needed {
+		if n-len(errs) < needed {
+			return acked, fmt.Errorf("%w: %d of %d acknowledged, %d needed: %w", ErrQuorum, acked, n, needed, errors.Join(errs...))
+		}
+		if err := <-results; err != nil {
+			errs = append(errs, err)
+		} else {
+			acked++
+		}
+	}
+	return acked, nil
+}
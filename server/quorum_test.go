@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jekki/gdss/p2p"
+)
+
+// deadPeer is a connected peer whose streams fail to open.
+type deadPeer struct {
+	p2p.Peer
+}
+
+func (deadPeer) Info() p2p.PeerInfo { return p2p.PeerInfo{ID: "dead"} }
+
+func (deadPeer) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+
+func (deadPeer) OpenStream() (p2p.Stream, error) {
+	return nil, errors.New("connection reset")
+}
+
+func (deadPeer) SendRequest(uint32, []byte) error {
+	return errors.New("connection reset")
+}
+
+// addDeadPeer registers a deadPeer with s.
+func addDeadPeer(s *FileServer) {
+	s.peerLock.Lock()
+	s.peers["dead"] = deadPeer{}
+	s.ring.Add("dead")
+	s.peerLock.Unlock()
+}
+
+func TestStoreInsufficientReplicas(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{ReplicationFactor: 3, WriteConsistency: ConsistencyAll})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+
+	// Two replicas are needed, but only one node is connected.
+	err := a.Store("key", bytes.NewReader([]byte("data")))
+	if !errors.Is(err, ErrInsufficientReplicas) {
+		t.Fatalf("expected ErrInsufficientReplicas, got %v", err)
+	}
+	if a.S.Has(a.ID, a.hashKey("key")) {
+		t.Error("expected nothing to be stored")
+	}
+
+	// A quorum of three is two nodes, this one and the connected replica.
+	if err := a.StoreWith("key", bytes.NewReader([]byte("data")), ConsistencyQuorum); err != nil {
+		t.Fatal(err)
+	}
+	if !b.S.Has(a.ID, a.hashKey("key")) {
+		t.Error("expected a replica on b")
+	}
+}
+
+func TestStoreUnreachablePeer(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	addDeadPeer(a)
+
+	// The dead peer counts as a missing acknowledgement.
+	err := a.StoreWith("key", bytes.NewReader([]byte("data")), ConsistencyAll)
+	if !errors.Is(err, ErrQuorum) {
+		t.Fatalf("expected ErrQuorum, got %v", err)
+	}
+	if err := a.StoreWith("key", bytes.NewReader([]byte("data")), ConsistencyQuorum); err != nil {
+		t.Fatal(err)
+	}
+
+	hashedKey := a.hashKey("key")
+	if err := a.S.Delete(a.ID, hashedKey); err != nil {
+		t.Fatal(err)
+	}
+	r, err := a.GetWith("key", ConsistencyQuorum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "data" {
+		t.Errorf("got %q: %v", got, err)
+	}
+}
+
+func TestPeersNeeded(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		EncKey:            make([]byte, 32),
+		StorageRoot:       t.TempDir(),
+		ReplicationFactor: 3,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddress: "127.0.0.1:0"}),
+	})
+
+	for _, tc := range []struct {
+		level     Consistency
+		connected int
+		needed    int
+	}{
+		{ConsistencyOne, 0, 0},
+		{ConsistencyQuorum, 1, 1},
+		{ConsistencyQuorum, 2, 1},
+		{ConsistencyAll, 2, 2},
+		{ConsistencyAll, 1, -1},
+		{ConsistencyQuorum, 0, -1},
+	} {
+		needed, err := s.peersNeeded(tc.level, tc.connected)
+		if tc.needed < 0 {
+			if !errors.Is(err, ErrInsufficientReplicas) {
+				t.Errorf("%s with %d connected: expected ErrInsufficientReplicas, got %v", tc.level, tc.connected, err)
+			}
+			continue
+		}
+		if err != nil || needed != tc.needed {
+			t.Errorf("%s with %d connected: want %d have %d, %v", tc.level, tc.connected, tc.needed, needed, err)
+		}
+	}
+}
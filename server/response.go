@@ -0,0 +1,235 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jekki/gdss/p2p"
+)
+
+// requestTimeout is how long requests without a stream wait for their
+// response.
+var requestTimeout = 5 * time.Second
+
+// responseTimeout is how long a requester whose stream failed waits for the
+// response telling why.
+var responseTimeout = time.Second
+
+// ErrNotFound is returned when a peer does not hold what it was asked for.
+var ErrNotFound = errors.New("not found")
+
+// Status is the outcome of a request.
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusNotFound:
+		return "not found"
+	}
+	return "error"
+}
+
+// statusOf returns the status a handler that returned err answers with.
+func statusOf(err error) Status {
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.Is(err, ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return StatusNotFound
+	}
+	return StatusError
+}
+
+// MessageResponse answers a request once its handler is done. It travels
+// with the ID of the request, see Message.
+type MessageResponse struct {
+	Status Status
+	// Error describes what went wrong unless Status is StatusOK.
+	Error string
+}
+
+// ResponseError is a failure a peer answered a request with.
+type ResponseError struct {
+	Peer   string
+	Status Status
+	Err    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("peer (%s) answered %s: %s", e.Peer, e.Status, e.Err)
+}
+
+// Is makes peers that answered StatusNotFound match ErrNotFound.
+func (e *ResponseError) Is(target error) bool {
+	return target == ErrNotFound && e.Status == StatusNotFound
+}
+
+// call is a request waiting for its response.
+type call struct {
+	id   uint32
+	peer string
+	done chan MessageResponse
+}
+
+// calls keeps track of the requests this node sent.
+type calls struct {
+	next    atomic.Uint32
+	mu      sync.Mutex
+	pending map[uint32]*call
+}
+
+func (c *calls) add(peer string) *call {
+	id := c.next.Add(1)
+	for id == 0 {
+		// Zero stands for no request.
+		id = c.next.Add(1)
+	}
+	cl := &call{id: id, peer: peer, done: make(chan MessageResponse, 1)}
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[uint32]*call)
+	}
+	c.pending[cl.id] = cl
+	c.mu.Unlock()
+	return cl
+}
+
+func (c *calls) remove(id uint32) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// expire removes the request id once its response had after to arrive,
+// for requests whose stream is done.
+func (c *calls) expire(id uint32, after time.Duration) {
+	time.AfterFunc(after, func() { c.remove(id) })
+}
+
+// drop removes the requests sent to peer.
+func (c *calls) drop(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, cl := range c.pending {
+		if cl.peer == peer {
+			delete(c.pending, id)
+		}
+	}
+}
+
+// resolve hands resp to the request id sent to peer, if any.
+func (c *calls) resolve(peer string, id uint32, resp MessageResponse) bool {
+	c.mu.Lock()
+	cl, ok := c.pending[id]
+	if ok && cl.peer == peer {
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+	if !ok || cl.peer != peer {
+		return false
+	}
+	cl.done <- resp
+	return true
+}
+
+// wait waits up to timeout for the response to cl and returns the failure
+// it reports, nil for StatusOK.
+func (s *FileServer) wait(cl *call, timeout time.Duration) error {
+	select {
+	case resp := <-cl.done:
+		if resp.Status == StatusOK {
+			return nil
+		}
+		return &ResponseError{Peer: cl.peer, Status: resp.Status, Err: resp.Error}
+	case <-time.After(timeout):
+		s.calls.remove(cl.id)
+		return fmt.Errorf("timeout while waiting for the response of (%s)", cl.peer)
+	}
+}
+
+// request sends msg to peer as a request and returns the call its response
+// is delivered to.
+func (s *FileServer) request(peer p2p.Peer, msg *Message) (*call, error) {
+	cl := s.calls.add(peerKey(peer))
+	if err := s.sendRequest(peer, cl.id, msg); err != nil {
+		s.calls.remove(cl.id)
+		return nil, err
+	}
+	return cl, nil
+}
+
+// requestStream is a stream opened along with a request. Once the stream
+// is reset or read to its end, the request is only kept for its response
+// to arrive.
+type requestStream struct {
+	p2p.Stream
+	call  *call
+	calls *calls
+	once  sync.Once
+}
+
+func (s *requestStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if err != nil {
+		s.done()
+	}
+	return n, err
+}
+
+func (s *requestStream) Reset() error {
+	s.done()
+	return s.Stream.Reset()
+}
+
+func (s *requestStream) done() {
+	s.once.Do(func() { s.calls.expire(s.call.id, responseTimeout) })
+}
+
+// failure explains why stream failed with err: if it belongs to a request
+// whose handler answered with a failure, that is returned instead, so
+// callers can tell e.g. a peer that lacks a file from one that broke down.
+func (s *FileServer) failure(stream p2p.Stream, err error) error {
+	rs, ok := stream.(*requestStream)
+	if !ok {
+		return err
+	}
+	if respErr := s.wait(rs.call, responseTimeout); respErr != nil {
+		var re *ResponseError
+		if errors.As(respErr, &re) {
+			return respErr
+		}
+	}
+	return err
+}
+
+// respond answers the request id of from with the outcome of its handler.
+func (s *FileServer) respond(from string, id uint32, err error) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+	resp := MessageResponse{Status: statusOf(err)}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return s.sendRequest(peer, id, &Message{Payload: resp})
+}
+
+func (s *FileServer) handleMessageResponse(from string, id uint32, msg MessageResponse) error {
+	if !s.calls.resolve(from, id, msg) {
+		return fmt.Errorf("unexpected response (%d) from %s", id, from)
+	}
+	return nil
+}
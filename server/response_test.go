@@ -0,0 +1,121 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestStatusOf(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status Status
+	}{
+		{nil, StatusOK},
+		{fmt.Errorf("file: %w", ErrNotFound), StatusNotFound},
+		{fmt.Errorf("file: %w", fs.ErrNotExist), StatusNotFound},
+		{errors.New("disk full"), StatusError},
+	} {
+		if got := statusOf(tc.err); got != tc.status {
+			t.Errorf("%v: want %s have %s", tc.err, tc.status, got)
+		}
+	}
+
+	err := error(&ResponseError{Peer: "peer", Status: StatusNotFound})
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("expected a not found response to match ErrNotFound")
+	}
+	err = &ResponseError{Peer: "peer", Status: StatusError}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("expected an error response not to match ErrNotFound")
+	}
+}
+
+// count returns how many requests c waits on.
+func (c *calls) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func TestCalls(t *testing.T) {
+	var c calls
+	a := c.add("a")
+	b := c.add("b")
+	if a.id == b.id {
+		t.Fatal("expected distinct request IDs")
+	}
+
+	// Only the peer a request was sent to answers it, once.
+	if c.resolve("b", a.id, MessageResponse{}) {
+		t.Error("expected a response of another peer to be refused")
+	}
+	if !c.resolve("a", a.id, MessageResponse{Status: StatusNotFound}) {
+		t.Fatal("expected the response to be taken")
+	}
+	if resp := <-a.done; resp.Status != StatusNotFound {
+		t.Errorf("got %s", resp.Status)
+	}
+	if c.resolve("a", a.id, MessageResponse{}) {
+		t.Error("expected a second response to be refused")
+	}
+
+	// Requests to a peer that went away are dropped.
+	c.drop("b")
+	if c.count() != 0 {
+		t.Errorf("expected no pending requests, got %d", c.count())
+	}
+
+	// Zero stands for no request, even once IDs wrap around.
+	c.next.Store(math.MaxUint32)
+	if cl := c.add("a"); cl.id == 0 {
+		t.Error("expected a non-zero request ID")
+	}
+}
+
+func TestCallsExpire(t *testing.T) {
+	var c calls
+	cl := c.add("a")
+	c.expire(cl.id, 10*time.Millisecond)
+	eventually(t, func() bool { return c.count() == 0 })
+}
+
+func TestRequestResponse(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+	peer, _ := a.peer(b.ID)
+
+	// b refuses to delete files a does not own and says why.
+	cl, err := a.request(peer, &Message{Payload: MessageDeleteFile{ID: b.ID, Key: "key", Deleted: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.wait(cl, requestTimeout)
+	var re *ResponseError
+	if !errors.As(err, &re) || re.Status != StatusError || re.Peer != b.ID {
+		t.Errorf("expected an error response of b, got %v", err)
+	}
+
+	// A request b cannot decode is answered with an error.
+	cl = a.calls.add(b.ID)
+	if err := peer.SendRequest(cl.id, []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	err = a.wait(cl, requestTimeout)
+	if !errors.As(err, &re) || re.Status != StatusError {
+		t.Errorf("expected an error response to an undecodable request, got %v", err)
+	}
+
+	// A peer that lacks a file resets the stream and answers not found.
+	_, err = a.probe(a.connectedPeers(), a.ID, "missing", 1)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Answered and abandoned requests are not kept around.
+	eventually(t, func() bool { return a.calls.count() == 0 })
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestRingLookup(t *testing.T) {
+	r := NewRing(0)
+	nodes := []string{"a", "b", "c", "d"}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	r.Add("a")
+	if r.Len() != len(nodes) {
+		t.Fatalf("expected %d nodes, got %d", len(nodes), r.Len())
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		found := r.Lookup(key, 3)
+		if len(found) != 3 {
+			t.Fatalf("%s: expected 3 nodes, got %v", key, found)
+		}
+		seen := make(map[string]bool)
+		for _, node := range found {
+			if seen[node] {
+				t.Fatalf("%s: node %s found twice in %v", key, node, found)
+			}
+			seen[node] = true
+		}
+		counts[found[0]]++
+	}
+	// Every node owns about a quarter of the keys.
+	for _, node := range nodes {
+		if counts[node] < 1500 || counts[node] > 3500 {
+			t.Errorf("node %s owns %d of 10000 keys", node, counts[node])
+		}
+	}
+
+	if got := r.Lookup("key", 10); len(got) != len(nodes) {
+		t.Errorf("expected all %d nodes, got %v", len(nodes), got)
+	}
+	if got := r.Lookup("key", 0); len(got) != 0 {
+		t.Errorf("expected no nodes, got %v", got)
+	}
+}
+
+func TestRingRemove(t *testing.T) {
+	r := NewRing(16)
+	for _, node := range []string{"a", "b", "c"} {
+		r.Add(node)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = r.Lookup(key, 1)[0]
+	}
+
+	r.Remove("b")
+	r.Remove("unknown")
+	if r.Len() != 2 {
+		t.Fatalf("expected 2 nodes, got %d", r.Len())
+	}
+	for key, owner := range before {
+		got := r.Lookup(key, 3)
+		if len(got) != 2 {
+			t.Fatalf("%s: expected 2 nodes, got %v", key, got)
+		}
+		// Only the keys of the removed node move.
+		if owner != "b" && got[0] != owner {
+			t.Errorf("%s moved from %s to %s", key, owner, got[0])
+		}
+		if got[0] == "b" || got[1] == "b" {
+			t.Errorf("%s: removed node still found", key)
+		}
+	}
+}
+
+func TestReplicationFactor(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 2}
+	a := newTestServer(t, opts)
+	b := newTestServer(t, opts)
+	c := newTestServer(t, opts)
+	connect(t, a, b)
+	connect(t, a, c)
+
+	// The owner keeps a copy, so every file has one replica.
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if err := a.Store(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+		var copies int
+		for _, s := range []*FileServer{a, b, c} {
+			if s.S.Has(a.ID, a.hashKey(key)) {
+				copies++
+			}
+		}
+		if copies != 2 {
+			t.Errorf("%s: expected 2 copies, found %d", key, copies)
+		}
+	}
+}
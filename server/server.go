@@ -2,13 +2,19 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jekki/gdss/dht"
 	"github.com/jekki/gdss/gcrypto"
 	"github.com/jekki/gdss/log"
 	"github.com/jekki/gdss/p2p"
@@ -16,12 +22,55 @@ import (
 )
 
 type FileServerOpts struct {
-	ID                string
-	EncKey            []byte
+	ID string
+	// Identity is the node's keypair. When set, the node ID is derived from
+	// its public key.
+	Identity *gcrypto.Identity
+	// EncKey is the key files replicated to peers are encrypted with,
+	// unless KeyRing has an active key of its own.
+	EncKey []byte
+	// KeyRing resolves the keys replicated files were encrypted with,
+	// including ones rotated out since. It defaults to just EncKey. If it
+	// is a gcrypto.ActiveKeyRing, such as a gcrypto.KeyStore, its active key
+	// is looked up on every use, so rotating it takes effect right away.
+	KeyRing gcrypto.KeyRing
+	// Recipients can decrypt every replicated file in addition to the
+	// holder of EncKey.
+	Recipients []gcrypto.Recipient
+	// ShareIdentity decrypts files other nodes shared with this one.
+	ShareIdentity *gcrypto.X25519Identity
+	// KeyHash hashes keys into the names files are stored under, locally
+	// and on peers. It defaults to SHA-256.
+	KeyHash           func() hash.Hash
 	StorageRoot       string
 	PathTransformFunc store.PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
+	// ContentAddressed deduplicates stored files by their contents, see
+	// store.StoreOpts.
+	ContentAddressed bool
+	// Backend holds the stored files. It defaults to files on disk in
+	// StorageRoot.
+	Backend store.Backend
+	// Chunking, if set, splits files into chunks that are replicated and
+	// deduplicated one by one instead of as a whole, see replicateChunks.
+	Chunking store.ChunkerFunc
+	// ReplicationFactor is how many nodes, the owner included, hold each
+	// file, see replicaNodes. Files are only sent to and fetched from the
+	// responsible peers. Every peer is if it is not positive.
+	ReplicationFactor int
+	// VirtualNodes is how many points every node gets on the ring. It
+	// defaults to DefaultVirtualNodes.
+	VirtualNodes int
+	// WriteConsistency is how many of the nodes holding a file have to
+	// store it for Store to succeed. It defaults to ConsistencyAll.
+	WriteConsistency Consistency
+	// ReadConsistency is how many replicas Get compares before fetching a
+	// file it does not hold. It defaults to ConsistencyOne.
+	ReadConsistency Consistency
+	// TombstoneGracePeriod is how long deletions are remembered, see
+	// Delete. It defaults to DefaultTombstoneGracePeriod.
+	TombstoneGracePeriod time.Duration
+	Transport            p2p.Transport
+	BootstrapNodes       []string
 }
 
 type FileServer struct {
@@ -29,194 +78,651 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
-	S        *store.Store
-	quitch   chan struct{}
+	// ring places files on this node and its peers.
+	ring *Ring
+	// routes are the nodes of the network this node knows of, whether
+	// connected or not.
+	routes *dht.RoutingTable
+	S      *store.Store
+	quitch chan struct{}
+
+	// calls are the requests waiting for their response.
+	calls calls
+	// serving is how many transfers to peers are in progress.
+	serving atomic.Int64
+
+	grantLock sync.Mutex
+	grants    map[string][]*gcrypto.X25519Recipient
+
+	// records are the holders of files this node is among the closest
+	// nodes to, see announce.
+	recordLock sync.Mutex
+	records    map[dht.ID]map[string]holderRecord
+
+	// dialed are the connections connect dialed, with when they were last
+	// used, see closeDialed.
+	dialLock sync.Mutex
+	dialed   map[string]time.Time
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := store.StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		ContentAddressed:  opts.ContentAddressed,
+		Backend:           opts.Backend,
 	}
 
+	if opts.Identity != nil {
+		opts.ID = opts.Identity.ID()
+	}
 	if len(opts.ID) == 0 {
 		opts.ID = gcrypto.GenerateID()
 	}
+	if opts.KeyRing == nil {
+		opts.KeyRing = gcrypto.StaticKey(opts.EncKey)
+	}
+	if opts.KeyHash == nil {
+		opts.KeyHash = sha256.New
+	}
+	if opts.WriteConsistency == ConsistencyDefault {
+		opts.WriteConsistency = ConsistencyAll
+	}
+	if opts.ReadConsistency == ConsistencyDefault {
+		opts.ReadConsistency = ConsistencyOne
+	}
+	if opts.TombstoneGracePeriod <= 0 {
+		opts.TombstoneGracePeriod = DefaultTombstoneGracePeriod
+	}
+
+	ring := NewRing(opts.VirtualNodes)
+	ring.Add(opts.ID)
 
 	return &FileServer{
 		FileServerOpts: opts,
+		ring:           ring,
+		routes:         dht.NewRoutingTable(opts.ID, dht.DefaultK),
 		S:              store.NewStore(storeOpts),
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		grants:         make(map[string][]*gcrypto.X25519Recipient),
+		records:        make(map[dht.ID]map[string]holderRecord),
+		dialed:         make(map[string]time.Time),
 	}
 }
 
+// Message is what peers send each other outside of streams. Messages sent
+// as requests are answered with a MessageResponse once handled; the frame
+// they travel in carries the ID tying the two together, see
+// p2p.RPC.RequestID.
 type Message struct {
 	Payload any
 }
 
+// MessageStoreFile announces a file that follows on the stream StreamID.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	ID  string
+	Key string
+	// Size is the size of the encrypted file, or -1 if the owner did not
+	// know it up front. The stream is then framed, see frameReader.
+	Size     int64
+	StreamID uint32
+	// Stored is when the owner stored the file. Replicas refuse files
+	// older than a deletion they know of.
+	Stored time.Time
+	// Chunks, if set, are the digests of the chunks of a file replicated
+	// with chunking. The stream then carries the chunks the receiver asks
+	// for, followed by the manifest of Size bytes, see receiveChunks.
+	Chunks []string
+}
+
+// MessageRewrapFile asks a peer to send the envelope of a replicated file on
+// the stream StreamID and replace it with the one sent back.
+type MessageRewrapFile struct {
+	ID       string
+	Key      string
+	StreamID uint32
 }
 
+// MessageGetFile asks for a file to be written back on the stream StreamID.
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ID       string
+	Key      string
+	StreamID uint32
+}
+
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	return s.sendRequest(peer, 0, msg)
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
+// sendRequest sends msg to peer as part of the request requestID.
+func (s *FileServer) sendRequest(peer p2p.Peer, requestID uint32, msg *Message) error {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
+	return peer.SendRequest(requestID, buf.Bytes())
+}
 
+// peer returns the connected peer registered under id.
+func (s *FileServer) peer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[id]
+	return peer, ok
+}
+
+// connectedPeers returns every connected peer.
+func (s *FileServer) connectedPeers() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// replicaNodes returns the nodes holding a replica of the file node id
+// stored under hashedKey, in order of preference. The owner keeps a copy of
+// its own, so these are the first ReplicationFactor-1 other nodes the ring
+// places the file on. Every node places it alike, so the owner and any
+// other node find the same replicas as long as they know the same nodes.
+func (s *FileServer) replicaNodes(id string, hashedKey string) []string {
+	nodes := s.ring.Lookup(id+"/"+hashedKey, s.ReplicationFactor)
+	replicas := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node != id && len(replicas) < s.ReplicationFactor-1 {
+			replicas = append(replicas, node)
 		}
 	}
+	return replicas
+}
 
-	return nil
+// replicas returns the connected peers holding the file node id stored
+// under hashedKey, in order of preference: the owner, unless that is this
+// node, followed by the connected ones of its replicaNodes. Every peer
+// does if ReplicationFactor is not positive.
+func (s *FileServer) replicas(id string, hashedKey string) []p2p.Peer {
+	if s.ReplicationFactor <= 0 {
+		return s.connectedPeers()
+	}
+
+	nodes := s.replicaNodes(id, hashedKey)
+	if id != s.ID {
+		nodes = append([]string{id}, nodes...)
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers := make([]p2p.Peer, 0, len(nodes))
+	for _, node := range nodes {
+		if peer, ok := s.peers[node]; ok {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// openStreams opens one stream to every peer in peers and announces it
+// with the message built by newMsg. Peers that fail are left out: the
+// streams to the others are returned along with what failed, which callers
+// count as missing answers.
+func (s *FileServer) openStreams(peers []p2p.Peer, newMsg func(streamID uint32) *Message) ([]p2p.Stream, []error) {
+	var (
+		streams = make([]p2p.Stream, 0, len(peers))
+		errs    []error
+	)
+	for _, peer := range peers {
+		stream, err := s.openStream(peer, newMsg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("peer (%s): %w", peerKey(peer), err))
+			continue
+		}
+		streams = append(streams, stream)
+	}
+	return streams, errs
+}
+
+// openStream opens a stream to peer and announces it with the message built
+// by newMsg.
+func (s *FileServer) openStream(peer p2p.Peer, newMsg func(streamID uint32) *Message) (p2p.Stream, error) {
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	cl, err := s.request(peer, newMsg(stream.ID()))
+	if err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	return &requestStream{Stream: stream, call: cl, calls: &s.calls}, nil
+}
+
+func resetStreams(streams []p2p.Stream) {
+	for _, stream := range streams {
+		stream.Reset()
+	}
 }
 
 func (s *FileServer) Get(key string) (io.Reader, error) {
+	return s.GetWith(key, ConsistencyDefault)
+}
+
+// GetWith returns the contents of key. This node's own copy is served if
+// it holds one, since it wrote every replica. Otherwise as many replicas
+// as level requires are asked for the file and the newest of their copies
+// is fetched.
+func (s *FileServer) GetWith(key string, level Consistency) (io.Reader, error) {
 	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	hashedKey := s.hashKey(key)
+	if level == ConsistencyDefault {
+		level = s.ReadConsistency
+	}
 
-	if s.S.Has(s.ID, key) {
+	if s.S.Has(s.ID, hashedKey) {
 		logger.Infof("serving file (%s) from local disk\n", key)
-		_, r, err := s.S.Read(s.ID, key)
+		_, r, err := s.S.Read(s.ID, hashedKey)
 		return r, err
 	}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: gcrypto.HashKey(key),
-		},
+	r, err := s.fetch(s.replicas(s.ID, hashedKey), hashedKey, level)
+	if err == nil {
+		return r, nil
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	// The replicas may have moved since the file was stored, or not be
+	// connected to this node. Ask the network who holds it.
+	peers := s.holderPeers(s.ID, hashedKey)
+	if len(peers) == 0 {
 		return nil, err
 	}
+	logger.Infof("fetching file (%s) from (%d) holders found in the network", key, len(peers))
+	return s.fetch(peers, hashedKey, level)
+}
 
-	timeout := time.After(time.Second * 5)
-	responseCh := make(chan io.Reader)
-	errCh := make(chan error)
+// fetch stores this node's file under hashedKey from one of peers and
+// returns it. As many of the nodes holding the file as level requires are
+// asked for it first, this one lacking its copy counting as one of them;
+// it is then fetched from the least loaded holder of the copy stored last,
+// falling over to the next holder if that fails.
+func (s *FileServer) fetch(peers []p2p.Peer, hashedKey string, level Consistency) (io.Reader, error) {
+	needed, err := s.peersNeeded(level, len(peers))
+	if err != nil {
+		return nil, err
+	}
+	if needed == 0 && len(peers) > 0 {
+		// The file still has to come from somewhere.
+		needed = 1
+	}
+	holders, err := s.probe(peers, s.ID, hashedKey, needed)
+	if err != nil {
+		return nil, err
+	}
+	return s.fetchFrom(s.rankHolders(holders, hashedKey), hashedKey)
+}
 
-	go func() {
-		var fileReader io.Reader
+// fetchFrom stores this node's file under hashedKey from the first of
+// holders that serves it and returns it.
+func (s *FileServer) fetchFrom(holders []holder, hashedKey string) (io.Reader, error) {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
 
-		for _, peer := range s.peers {
-			var fileSize int64
-			if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
-				errCh <- err
-				return
-			}
+	var errs []error
+	for _, h := range holders {
+		n, err := s.download(h, hashedKey)
+		if err != nil {
+			logger.Warnf("fetching file (%s) from peer (%s) failed: %s", hashedKey, peerKey(h.peer), err)
+			errs = append(errs, err)
+			continue
+		}
+		logger.Infof("received (%d) bytes over the network from peer (%s)", n, peerKey(h.peer))
+
+		_, r, err := s.S.Read(s.ID, hashedKey)
+		return r, err
+	}
+	return nil, fmt.Errorf("no holder could serve file (%s): %w", hashedKey, errors.Join(errs...))
+}
 
-			reader := io.LimitReader(peer, fileSize)
+// download stores this node's file under hashedKey from h.
+func (s *FileServer) download(h holder, hashedKey string) (int64, error) {
+	stream, header, err := s.openFile(h, s.ID, hashedKey)
+	if err != nil {
+		return 0, err
+	}
+	reader := newIdleReader(io.LimitReader(stream, header.Size), stream)
+	defer reader.Stop()
+
+	var n int64
+	if header.Chunked {
+		n, err = s.receiveChunked(h.peer, hashedKey, reader)
+	} else {
+		n, err = s.S.WriteDecrypt(s.KeyRing, s.ID, hashedKey, reader)
+	}
+	if err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	return n, stream.Close()
+}
 
-			n, err := s.S.WriteDecrypt(s.EncKey, s.ID, key, reader)
-			if err != nil {
-				errCh <- err
-				return
-			}
+func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.StoreWith(key, r, ConsistencyDefault)
+}
+
+// StoreWith stores key here and on its replicas, and succeeds once as many
+// of the nodes holding it as level requires stored it, this one included.
+// Replicas acknowledge the size and digest of what they stored; those that
+// cannot be reached count as missing acknowledgements. Nothing is stored
+// if too few of the nodes are connected to reach level to begin with.
+func (s *FileServer) StoreWith(key string, r io.Reader, level Consistency) error {
+	var (
+		head   = new(headBuffer)
+		stored = time.Now().UTC()
+	)
+	if level == ConsistencyDefault {
+		level = s.WriteConsistency
+	}
 
-			logger.Infof("received (%d) bytes over the network from (%s)", n, peer.RemoteAddr())
+	hashedKey := s.hashKey(key)
+	peers := s.replicas(s.ID, hashedKey)
+	// The local copy is one of the acknowledgements.
+	needed, err := s.peersNeeded(level, len(peers))
+	if err != nil {
+		return err
+	}
+	if s.Chunking != nil {
+		// Chunks are read back from disk one at a time once the file is
+		// stored.
+		if _, err := s.S.Write(s.ID, hashedKey, io.TeeReader(r, head)); err != nil {
+			return err
+		}
+		if err := s.setAttrs(key, hashedKey, head); err != nil {
+			return err
+		}
+		if err := s.replicateChunks(key, hashedKey, stored, peers, needed); err != nil {
+			return err
+		}
+		go s.announce(s.ID, hashedKey, peers)
+		return nil
+	}
 
-			peer.CloseStream()
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	recipients := s.recipients(key)
+
+	// Peers learn the size up front if it is known, otherwise the data is
+	// framed and followed by a trailer.
+	size := readerSize(r)
+	msgSize := int64(-1)
+	if size >= 0 {
+		msgSize = gcrypto.EncryptedSize(size, recipients...)
+	}
+
+	streams, errs := s.openStreams(peers, func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageStoreFile{
+				ID:       s.ID,
+				Key:      hashedKey,
+				Size:     msgSize,
+				StreamID: streamID,
+				Stored:   stored,
+			},
 		}
+	})
+	if len(streams) < needed {
+		resetStreams(streams)
+		return fmt.Errorf("%w: %d of %d peers reachable, %d needed: %w", ErrQuorum, len(streams), len(peers), needed, errors.Join(errs...))
+	}
 
-		_, fileReader, err := s.S.Read(s.ID, key)
+	// The file is written to disk and sent to peers as it is read, so
+	// whichever is slower holds back the other.
+	pr, pw := io.Pipe()
+	replicated := make(chan error, 1)
+	go func() {
+		n, err := s.replicate(pr, streams, recipients, size >= 0, needed)
 		if err != nil {
-			errCh <- err
-			return
+			// Keep the local copy going without the peers.
+			io.Copy(io.Discard, pr)
+		} else {
+			logger.Infof("received and written (%d) bytes to disk\n", n)
 		}
-		responseCh <- fileReader
+		replicated <- err
 	}()
 
-	select {
-	case r := <-responseCh:
-		return r, nil
-	case err := <-errCh:
-		return nil, err
-	case <-timeout:
-		return nil, fmt.Errorf("timeout while waiting for file from peers")
+	_, err = s.S.Write(s.ID, hashedKey, io.TeeReader(io.TeeReader(r, head), pw))
+	// A failed local write fails the transfer to peers as well.
+	pw.CloseWithError(err)
+	replicateErr := <-replicated
+	if err != nil {
+		return err
+	}
+	if err := s.setAttrs(key, hashedKey, head); err != nil {
+		return err
 	}
+	if replicateErr != nil {
+		return fmt.Errorf("failed to send file to peers: %w", replicateErr)
+	}
+	// The file is stored already, it does not wait on the lookups of
+	// announcing it.
+	go s.announce(s.ID, hashedKey, peers)
+	return nil
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+// setAttrs records the name and content type of the file stored under
+// hashedKey, whose first bytes head holds. Only the owner learns the plain
+// key, peers just see its hash.
+func (s *FileServer) setAttrs(key string, hashedKey string, head *headBuffer) error {
+	attrs := map[string]string{
+		store.NameAttr: key,
+		"content-type": http.DetectContentType(head.Bytes()),
+		grantsAttr:     formatGrants(s.grantsOf(key)),
+	}
+	return s.S.SetAttrs(s.ID, hashedKey, attrs)
+}
 
-	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+// headBuffer keeps the first bytes written to it, enough to detect their
+// content type.
+type headBuffer struct {
+	bytes.Buffer
+}
 
-	size, err := s.S.Write(s.ID, key, tee)
-	if err != nil {
-		return err
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if rem := 512 - b.Len(); rem > 0 {
+		if len(p) > rem {
+			b.Buffer.Write(p[:rem])
+		} else {
+			b.Buffer.Write(p)
+		}
 	}
+	return len(p), nil
+}
+
+// hashKey returns the name key is stored under, locally and on peers.
+func (s *FileServer) hashKey(key string) string {
+	return gcrypto.HashKeyWith(s.KeyHash, key)
+}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  gcrypto.HashKey(key),
-			Size: size + 16,
-		},
+// MigrateStorage moves the files of keys stored by earlier releases, which
+// hashed keys with MD5 and laid them out by their SHA-1 digest, to where
+// they are looked up now. Both this node's own files and the replicas it
+// holds for peers are moved. Files of keys not listed are left in place.
+func (s *FileServer) MigrateStorage(keys []string) error {
+	m := make(map[string]string, 2*len(keys))
+	for _, key := range keys {
+		// Own files used the plain key, replicas the MD5 of it.
+		m[key] = s.hashKey(key)
+		m[gcrypto.LegacyHashKey(key)] = s.hashKey(key)
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	migrated, remaining, err := s.S.Migrate(store.LegacyCASPathTransformFunc, m)
+	if err != nil {
 		return err
 	}
 
-	timeout := time.After(time.Second * 5)
-	responseCh := make(chan error)
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	logger.Infof("migrated (%d) files to storage layout version %d, (%d) left behind", migrated, store.CurrentLayout, remaining)
+	return nil
+}
 
-	go func() {
-		time.Sleep(time.Millisecond * 500)
+// Stat returns the metadata of this node's own copy of key.
+func (s *FileServer) Stat(key string) (store.FileInfo, error) {
+	return s.S.Stat(s.ID, s.hashKey(key))
+}
 
-		peers := []io.Writer{}
-		for _, peer := range s.peers {
-			peers = append(peers, peer)
-		}
+// activeKey returns the key new replicated data is encrypted with.
+func (s *FileServer) activeKey() []byte {
+	if ring, ok := s.KeyRing.(gcrypto.ActiveKeyRing); ok {
+		return ring.ActiveKey()
+	}
+	return s.EncKey
+}
 
-		mw := io.MultiWriter(peers...)
-		mw.Write([]byte{p2p.IncomingStream})
+// recipients returns who the data key of the replicated copies of key is
+// wrapped for.
+func (s *FileServer) recipients(key string) []gcrypto.Recipient {
+	recipients := append([]gcrypto.Recipient{gcrypto.KeyRecipient(s.activeKey())}, s.Recipients...)
+	for _, r := range s.grantsOf(key) {
+		recipients = append(recipients, r)
+	}
+	return recipients
+}
 
-		n, err := gcrypto.CopyEncrypt(s.EncKey, fileBuffer, mw)
-		if err != nil {
-			responseCh <- err
-			return
+// RewrapFile rewraps the data key of every replicated copy of key for the
+// active key, Recipients and grants, e.g. after the master key was
+// rotated. The encrypted bodies stay on the peers untouched, only their
+// envelopes travel.
+func (s *FileServer) RewrapFile(key string) error {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+
+	hashedKey := s.hashKey(key)
+	streams, errs := s.openStreams(s.replicas(s.ID, hashedKey), func(streamID uint32) *Message {
+		return &Message{
+			Payload: MessageRewrapFile{
+				ID:       s.ID,
+				Key:      hashedKey,
+				StreamID: streamID,
+			},
+		}
+	})
+	for _, stream := range streams {
+		if err := s.rewrapEnvelope(stream, s.recipients(key)); err != nil {
+			stream.Reset()
+			errs = append(errs, fmt.Errorf("stream %d: %w", stream.ID(), s.failure(stream, err)))
+			continue
 		}
+		logger.Infof("rewrapped file (%s) on stream (%d)", key, stream.ID())
+	}
+	return errors.Join(errs...)
+}
 
-		logger.Infof("received and written (%d) bytes to disk\n", n)
-		responseCh <- nil
-	}()
+func (s *FileServer) rewrapEnvelope(stream p2p.Stream, recipients []gcrypto.Recipient) error {
+	e, err := gcrypto.ReadEnvelope(stream)
+	if err != nil {
+		return err
+	}
+	unwrappers := []gcrypto.Unwrapper{gcrypto.KeyRingUnwrapper{KeyRing: s.KeyRing}}
+	if err := e.Rewrap(unwrappers, recipients...); err != nil {
+		return err
+	}
+	if _, err := stream.Write(e.Marshal()); err != nil {
+		return err
+	}
+	stream.Close()
 
-	select {
-	case err := <-responseCh:
-		if err != nil {
-			return fmt.Errorf("failed to send file to peers: %w", err)
-		}
-	case <-timeout:
-		return fmt.Errorf("timeout while waiting for file transfer to peers")
+	// The peer closes its side once the new envelope is on disk.
+	_, err = io.Copy(io.Discard, stream)
+	return err
+}
+
+// NodeInfo returns what this server advertises to peers during the handshake.
+func (s *FileServer) NodeInfo() p2p.PeerInfo {
+	return p2p.PeerInfo{
+		ID:           s.ID,
+		ListenAddr:   s.Transport.Addr(),
+		Version:      p2p.ProtocolVersion,
+		Capabilities: []string{p2p.CapabilityStreams},
 	}
+}
 
-	return nil
+// peerKey returns the node ID of p, or its remote address for peers that
+// did not perform a handshake.
+func peerKey(p p2p.Peer) string {
+	if id := p.Info().ID; len(id) > 0 {
+		return id
+	}
+	return p.RemoteAddr().String()
 }
 
+// OnPeer registers a connected peer under its node ID, falling back to the
+// remote address for peers that did not perform a handshake. A node
+// connected twice keeps only one of the connections, see preferred.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
-	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
 	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
-	logger.Infof("connected with remote %s", p.RemoteAddr())
+	key := peerKey(p)
+
+	s.peerLock.Lock()
+	old, ok := s.peers[key]
+	if ok && !s.preferred(old, p) {
+		s.peerLock.Unlock()
+		logger.Infof("dropping duplicate connection with remote %s (%s)", key, p.RemoteAddr())
+		p.Close()
+		return nil
+	}
+	s.peers[key] = p
+	s.ring.Add(key)
+	s.peerLock.Unlock()
+
+	if ok {
+		logger.Infof("replacing connection with remote %s (%s)", key, old.RemoteAddr())
+		old.Close()
+	}
+	s.addContact(p)
+	logger.Infof("connected with remote %s (%s)", key, p.RemoteAddr())
+
+	go s.sendTombstones(p)
 	return nil
 }
 
+// preferred reports whether p replaces old as the connection to the same
+// node. Both ends keep the connection dialed by the node with the lower ID,
+// so two nodes that dial each other at once end up sharing one; a node
+// that dials again replaces its earlier connection.
+func (s *FileServer) preferred(old p2p.Peer, p p2p.Peer) bool {
+	dialer := func(peer p2p.Peer) string {
+		if peer.Outbound() {
+			return s.ID
+		}
+		return peerKey(peer)
+	}
+	if dialer(old) == dialer(p) {
+		return true
+	}
+	return dialer(p) < dialer(old)
+}
+
+// OnPeerClose forgets a peer whose connection is gone: it no longer holds
+// replicas, and unless it hung up, is no contact of the routing table
+// either, see forgetPeer. Connections that were replaced by another one to
+// the same node are ignored.
+func (s *FileServer) OnPeerClose(p p2p.Peer, err error) {
+	key := peerKey(p)
+
+	s.peerLock.Lock()
+	if current, ok := s.peers[key]; !ok || current != p {
+		s.peerLock.Unlock()
+		return
+	}
+	delete(s.peers, key)
+	s.ring.Remove(key)
+	s.peerLock.Unlock()
+
+	s.forgetPeer(key, err)
+	// Requests to the peer are not answered anymore.
+	s.calls.drop(key)
+
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	logger.Infof("disconnected from remote %s (%s): %v", key, p.RemoteAddr(), err)
+}
+
 func (s *FileServer) loop() {
 	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
 
@@ -230,11 +736,33 @@ func (s *FileServer) loop() {
 		case rpc := <-s.Transport.Consume():
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Infoln("decoding error: ", err)
-			}
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				logger.Infoln("handle message error: ", err)
+				logger.Infoln("decoding error: ", err)
+				// Tell the sender its request was not understood rather than
+				// handling an empty message.
+				if rpc.RequestID != 0 {
+					go func(from string, requestID uint32) {
+						err := fmt.Errorf("decoding request: %w", err)
+						if err := s.respond(from, requestID, err); err != nil {
+							logger.Infoln("response error: ", err)
+						}
+					}(rpc.From, rpc.RequestID)
+				}
+				continue
 			}
+			// Handlers stream file contents, so run them concurrently to let
+			// several transfers share a connection.
+			go func(from string, requestID uint32) {
+				err := s.handleMessage(from, requestID, &msg)
+				if err != nil {
+					logger.Infoln("handle message error: ", err)
+				}
+				if _, ok := msg.Payload.(MessageResponse); ok || requestID == 0 {
+					return
+				}
+				if err := s.respond(from, requestID, err); err != nil {
+					logger.Infoln("response error: ", err)
+				}
+			}(rpc.From, rpc.RequestID)
 
 		case <-s.quitch:
 			return
@@ -242,12 +770,32 @@ func (s *FileServer) loop() {
 	}
 }
 
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+func (s *FileServer) handleMessage(from string, requestID uint32, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
 		return s.handleMessageStoreFile(from, v)
 	case MessageGetFile:
 		return s.handleMessageGetFile(from, v)
+	case MessageHasFile:
+		return s.handleMessageHasFile(from, v)
+	case MessageGetChunks:
+		return s.handleMessageGetChunks(from, v)
+	case MessageRewrapFile:
+		return s.handleMessageRewrapFile(from, v)
+	case MessageListFiles:
+		return s.handleMessageListFiles(from, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, v)
+	case MessageTombstones:
+		return s.handleMessageTombstones(from, v)
+	case MessageFindNode:
+		return s.handleMessageFindNode(from, v)
+	case MessageFindValue:
+		return s.handleMessageFindValue(from, v)
+	case MessageStoreValue:
+		return s.handleMessageStoreValue(from, v)
+	case MessageResponse:
+		return s.handleMessageResponse(from, requestID, v)
 	}
 
 	return nil
@@ -255,14 +803,29 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 
 func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
 	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
 	if !s.S.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+		stream.Reset()
+		return fmt.Errorf("%w: [%s] need to serve file (%s) but it does not exist on disk", ErrNotFound, s.Transport.Addr(), msg.Key)
 	}
 
+	s.serving.Add(1)
+	defer s.serving.Add(-1)
+
 	logger.Infof("serving file (%s) over the network\n", msg.Key)
 
 	fileSize, r, err := s.S.Read(msg.ID, msg.Key)
 	if err != nil {
+		stream.Reset()
 		return err
 	}
 
@@ -271,40 +834,108 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	header := fileHeader{Size: fileSize}
+	if fi, err := s.S.Stat(msg.ID, msg.Key); err == nil {
+		header = fileHeaderOf(fi)
+		header.Size = fileSize
 	}
-
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	if err := binary.Write(stream, binary.LittleEndian, header); err != nil {
+		stream.Reset()
+		return err
+	}
+	n, err := io.Copy(stream, r)
 	if err != nil {
+		stream.Reset()
 		return err
 	}
 
 	logger.Infof("written (%d) bytes over the network to %s\n", n, from)
 
-	return nil
+	return stream.Close()
 }
 
 func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
 	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
-	peer, ok := s.peers[from]
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.S.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	stream, err := peer.AcceptStream(msg.StreamID)
 	if err != nil {
 		return err
 	}
 
+	if t, ok := s.S.Tombstone(msg.ID, msg.Key); ok && !msg.Stored.After(t.Deleted) {
+		stream.Reset()
+		return fmt.Errorf("refusing file (%s) deleted at %s", msg.Key, t.Deleted)
+	}
+
+	var n int64
+	if len(msg.Chunks) > 0 {
+		n, err = s.receiveChunks(stream, msg)
+	} else {
+		// A transfer cut short must not leave a truncated replica behind.
+		var r io.Reader = io.LimitReader(stream, msg.Size)
+		if msg.Size < 0 {
+			r = newFrameReader(stream)
+		}
+		n, err = s.S.WriteVerified(msg.ID, msg.Key, r, msg.Size, "")
+	}
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+
 	logger.Infof("written %d bytes to disk\n", n)
 
-	peer.CloseStream()
+	fi, err := s.S.Stat(msg.ID, msg.Key)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	if err := gob.NewEncoder(stream).Encode(storeAck{Size: fi.Size, Digest: fi.Digest}); err != nil {
+		stream.Reset()
+		return err
+	}
+	go s.announce(msg.ID, msg.Key, nil)
+	return stream.Close()
+}
+
+func (s *FileServer) handleMessageRewrapFile(from string, msg MessageRewrapFile) error {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
 
-	return nil
+	stream, err := peer.AcceptStream(msg.StreamID)
+	if err != nil {
+		return err
+	}
+
+	err = s.S.RewriteEnvelope(msg.ID, msg.Key, func(e *gcrypto.Envelope) error {
+		if _, err := stream.Write(e.Marshal()); err != nil {
+			return err
+		}
+		rewrapped, err := gcrypto.ReadEnvelope(stream)
+		if err != nil {
+			return err
+		}
+		if !e.SameStream(rewrapped) {
+			return fmt.Errorf("rewrapped envelope of (%s) belongs to another stream", msg.Key)
+		}
+		e.Stanzas = rewrapped.Stanzas
+		return nil
+	})
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+
+	logger.Infof("rewrapped envelope of file (%s)", msg.Key)
+
+	return stream.Close()
 }
 
 func (s *FileServer) bootstrapNetwork() error {
@@ -326,14 +957,28 @@ func (s *FileServer) Stop() {
 }
 
 func (s *FileServer) Start() error {
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	if version, err := s.S.LayoutVersion(); err == nil && version != store.CurrentLayout {
+		logger.Warnf("storage layout version %d is outdated, run MigrateStorage", version)
+	}
+	if n, err := s.S.CleanTemp(); err != nil {
+		logger.Warnf("removing temp files of interrupted writes: %v", err)
+	} else if n > 0 {
+		logger.Infof("removed (%d) temp files of interrupted writes", n)
+	}
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
 	if len(s.BootstrapNodes) != 0 {
 		s.bootstrapNetwork()
+		go s.joinNetwork()
 	}
 
+	go s.collectTombstones()
+	go s.closeIdlePeers()
+
 	s.loop()
 	return nil
 }
@@ -341,4 +986,14 @@ func (s *FileServer) Start() error {
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageHasFile{})
+	gob.Register(MessageGetChunks{})
+	gob.Register(MessageRewrapFile{})
+	gob.Register(MessageListFiles{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageTombstones{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageStoreValue{})
+	gob.Register(MessageResponse{})
 }
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/p2p"
+	"github.com/jekki/gdss/store"
+)
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newTestServer starts a server listening on loopback. Servers started by
+// a test share EncKey, as nodes of the same owner do.
+func newTestServer(t *testing.T, opts FileServerOpts) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddress: freeAddr(t),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	if opts.EncKey == nil {
+		opts.EncKey = make([]byte, 32)
+	}
+	opts.StorageRoot = t.TempDir()
+	opts.Transport = tr
+
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerClose = s.OnPeerClose
+	tr.HandshakeFunc = p2p.NewHandshakeFunc(p2p.HandshakeOpts{Info: s.NodeInfo()})
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+	eventually(t, func() bool {
+		conn, err := net.Dial("tcp", tr.Addr())
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return s
+}
+
+// connect dials b from a and waits until both registered the other.
+func connect(t *testing.T, a *FileServer, b *FileServer) {
+	if err := a.Transport.Dial(b.Transport.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		_, ok := a.peer(b.ID)
+		_, ok2 := b.peer(a.ID)
+		return ok && ok2
+	})
+}
+
+// eventually fails the test unless cond holds within a few seconds.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+// unsized hides the size of the reader it wraps, as e.g. a network
+// connection would.
+type unsized struct {
+	r io.Reader
+}
+
+func (r unsized) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestPeersByNodeID(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+
+	// The inbound side knows the peer by its node ID, not by the ephemeral
+	// port it dialed from.
+	peer, _ := b.peer(a.ID)
+	if peer.Info().ListenAddr != a.Transport.Addr() {
+		t.Errorf("peer advertised %s, listens on %s", peer.Info().ListenAddr, a.Transport.Addr())
+	}
+	if len(b.connectedPeers()) != 1 {
+		t.Errorf("expected a single peer, got %d", len(b.connectedPeers()))
+	}
+
+	// Disconnected peers are forgotten and may connect again.
+	peer.Close()
+	eventually(t, func() bool {
+		_, ok := a.peer(b.ID)
+		_, ok2 := b.peer(a.ID)
+		return !ok && !ok2
+	})
+	connect(t, a, b)
+}
+
+func TestStoreGetDelete(t *testing.T) {
+	for _, sized := range []bool{true, false} {
+		a := newTestServer(t, FileServerOpts{})
+		b := newTestServer(t, FileServerOpts{})
+		c := newTestServer(t, FileServerOpts{})
+		connect(t, a, b)
+		connect(t, a, c)
+
+		// Files of unknown size are framed, make them span several frames.
+		data := make([]byte, 2*maxDataFrame+100)
+		rand.New(rand.NewSource(1)).Read(data)
+		var r io.Reader = bytes.NewReader(data)
+		if !sized {
+			r = unsized{r}
+		}
+		if err := a.Store("key", r); err != nil {
+			t.Fatalf("sized %v: %v", sized, err)
+		}
+
+		hashedKey := a.hashKey("key")
+		for _, peer := range []*FileServer{b, c} {
+			if !peer.S.Has(a.ID, hashedKey) {
+				t.Errorf("sized %v: expected a replica on %s", sized, peer.ID)
+			}
+		}
+
+		// Without its own copy, a fetches the file back from a replica.
+		if err := a.S.Delete(a.ID, hashedKey); err != nil {
+			t.Fatal(err)
+		}
+		got, err := a.Get("key")
+		if err != nil {
+			t.Fatalf("sized %v: %v", sized, err)
+		}
+		if b, err := io.ReadAll(got); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("sized %v: got %d bytes: %v", sized, len(b), err)
+		}
+
+		if err := a.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		for _, peer := range []*FileServer{a, b, c} {
+			if peer.S.Has(a.ID, hashedKey) {
+				t.Errorf("sized %v: expected the file to be deleted on %s", sized, peer.ID)
+			}
+			if _, ok := peer.S.Tombstone(a.ID, hashedKey); !ok {
+				t.Errorf("sized %v: expected a tombstone on %s", sized, peer.ID)
+			}
+		}
+	}
+}
+
+func TestDeleteReachesOfflineReplica(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{})
+	connect(t, a, b)
+
+	if err := a.Store("key", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	hashedKey := a.hashKey("key")
+	// Owner and replica announce themselves in the background, which may
+	// dial the other, so let them finish before hanging up.
+	key := dhtKey(a.ID, hashedKey)
+	eventually(t, func() bool {
+		return hasContact(a.holders(key), b.ID) && hasContact(b.holders(key), a.ID)
+	})
+
+	peer, _ := a.peer(b.ID)
+	peer.Close()
+	eventually(t, func() bool {
+		_, ok := b.peer(a.ID)
+		return !ok
+	})
+	// Peers that miss the deletion do not fail it.
+	addDeadPeer(a)
+	if err := a.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if !b.S.Has(a.ID, hashedKey) {
+		t.Fatal("expected the replica to miss the deletion while offline")
+	}
+
+	// The replica catches up on the tombstone once it is back.
+	connect(t, b, a)
+	eventually(t, func() bool {
+		return !b.S.Has(a.ID, hashedKey)
+	})
+}
+
+func TestFrameReader(t *testing.T) {
+	data := make([]byte, maxDataFrame+10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	framed := new(bytes.Buffer)
+	fw := newFrameWriter(framed)
+	if _, err := fw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(newFrameReader(bytes.NewReader(framed.Bytes()))); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes: %v", len(got), err)
+	}
+
+	// Data altered on the way does not match the trailer.
+	altered := bytes.Clone(framed.Bytes())
+	altered[10] ^= 0xff
+	if _, err := io.ReadAll(newFrameReader(bytes.NewReader(altered))); !errors.Is(err, store.ErrMismatch) {
+		t.Errorf("altered data: %v", err)
+	}
+
+	// A trailer claiming more data than was sent.
+	short := new(bytes.Buffer)
+	binary.Write(short, binary.LittleEndian, uint32(0))
+	binary.Write(short, binary.LittleEndian, dataTrailer{Size: 1})
+	if _, err := io.ReadAll(newFrameReader(short)); !errors.Is(err, store.ErrMismatch) {
+		t.Errorf("size mismatch: %v", err)
+	}
+
+	// A stream that ends before its trailer.
+	cut := framed.Bytes()[:framed.Len()-1]
+	if _, err := io.ReadAll(newFrameReader(bytes.NewReader(cut))); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut stream: %v", err)
+	}
+}
+
+// stalledStream takes no data until it is reset.
+type stalledStream struct {
+	p2p.Stream
+	once  sync.Once
+	reset chan struct{}
+}
+
+func (s *stalledStream) ID() uint32 { return 1 }
+
+func (s *stalledStream) Write(p []byte) (int, error) {
+	<-s.reset
+	return 0, errors.New("stream reset")
+}
+
+func (s *stalledStream) Reset() error {
+	s.once.Do(func() { close(s.reset) })
+	return nil
+}
+
+// sinkStream takes all data.
+type sinkStream struct {
+	p2p.Stream
+	buf bytes.Buffer
+}
+
+func (s *sinkStream) ID() uint32                  { return 2 }
+func (s *sinkStream) Write(p []byte) (int, error) { return s.buf.Write(p) }
+func (s *sinkStream) Reset() error                { return nil }
+
+func TestFanoutStall(t *testing.T) {
+	defer func(timeout time.Duration) { storeStallTimeout = timeout }(storeStallTimeout)
+	storeStallTimeout = 50 * time.Millisecond
+
+	stalled := &stalledStream{reset: make(chan struct{})}
+	sink := new(sinkStream)
+	fan := newFanout([]p2p.Stream{stalled, sink}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go fan.watch(done)
+
+	// The stalled peer is given up, the transfer goes on with the other.
+	if _, err := fan.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if fan.errs[0] == nil {
+		t.Error("expected the stalled stream to be left out")
+	}
+	if sink.buf.String() != "data" {
+		t.Errorf("got %q", sink.buf.String())
+	}
+
+	// Once too few peers remain, the transfer fails.
+	fan = newFanout([]p2p.Stream{&stalledStream{reset: make(chan struct{})}}, 1)
+	go fan.watch(done)
+	if _, err := fan.Write([]byte("data")); !errors.Is(err, ErrQuorum) {
+		t.Errorf("expected ErrQuorum, got %v", err)
+	}
+}
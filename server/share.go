@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/jekki/gdss/gcrypto"
+	"github.com/jekki/gdss/log"
+	"github.com/jekki/gdss/p2p"
+)
+
+// grantsAttr is the attribute of this node's copy of a file that lists who
+// it is shared with, so grants survive restarts.
+const grantsAttr = "shared-with"
+
+// Share grants recipients access to key: the replicated copies of the file
+// are rewrapped so that the data key is wrapped for them as well. The grant
+// replaces any previous one, so revoking is sharing with the remaining
+// recipients (see Revoke). Grants are recorded along with the attributes
+// of the file and also apply when key is stored again.
+//
+// Rewrapping keeps the data key, so a revoked recipient that kept it can
+// still decrypt the current copies; store the file again to encrypt it with
+// a fresh data key.
+func (s *FileServer) Share(key string, recipients ...*gcrypto.X25519Recipient) error {
+	if err := s.setGrants(key, recipients); err != nil {
+		return err
+	}
+	return s.RewrapFile(key)
+}
+
+// Revoke withdraws the access recipient was granted to key.
+func (s *FileServer) Revoke(key string, recipient *gcrypto.X25519Recipient) error {
+	var remaining []*gcrypto.X25519Recipient
+	for _, r := range s.grantsOf(key) {
+		if r.String() != recipient.String() {
+			remaining = append(remaining, r)
+		}
+	}
+	return s.Share(key, remaining...)
+}
+
+// grantsOf returns who key is shared with. Grants of files stored before
+// this node started are read back from their attributes.
+func (s *FileServer) grantsOf(key string) []*gcrypto.X25519Recipient {
+	s.grantLock.Lock()
+	defer s.grantLock.Unlock()
+	if recipients, ok := s.grants[key]; ok {
+		return recipients
+	}
+
+	fi, err := s.S.Stat(s.ID, s.hashKey(key))
+	if err != nil {
+		return nil
+	}
+	recipients, err := parseGrants(fi.Attrs[grantsAttr])
+	if err != nil {
+		logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+		logger.Warnf("reading grants of file (%s): %v", key, err)
+	}
+	s.grants[key] = recipients
+	return recipients
+}
+
+// setGrants replaces the grants of key, and records them with this node's
+// copy of the file if it holds one.
+func (s *FileServer) setGrants(key string, recipients []*gcrypto.X25519Recipient) error {
+	s.grantLock.Lock()
+	s.grants[key] = recipients
+	s.grantLock.Unlock()
+
+	err := s.S.SetAttrs(s.ID, s.hashKey(key), map[string]string{grantsAttr: formatGrants(recipients)})
+	if errors.Is(err, fs.ErrNotExist) {
+		// The grants are recorded once the file is stored, see setAttrs.
+		return nil
+	}
+	return err
+}
+
+// formatGrants returns the value of grantsAttr for recipients, which is
+// empty if there are none.
+func formatGrants(recipients []*gcrypto.X25519Recipient) string {
+	fields := make([]string, len(recipients))
+	for i, r := range recipients {
+		fields[i] = r.String()
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseGrants parses a value of grantsAttr, skipping recipients it cannot
+// parse.
+func parseGrants(attr string) ([]*gcrypto.X25519Recipient, error) {
+	var (
+		recipients []*gcrypto.X25519Recipient
+		errs       []error
+	)
+	for _, field := range strings.Fields(attr) {
+		r, err := gcrypto.ParseX25519Recipient(field)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, errors.Join(errs...)
+}
+
+// GetShared returns the contents of the file owner shared with this node
+// under key, decrypted with ShareIdentity. The replicated copy held by this
+// node is used if there is one, otherwise it is fetched from a peer.
+func (s *FileServer) GetShared(owner string, key string) (io.Reader, error) {
+	if s.ShareIdentity == nil {
+		return nil, fmt.Errorf("no share identity configured")
+	}
+
+	logger := log.WithServerContext(s.Transport.Addr(), s.ID)
+	hashedKey := s.hashKey(key)
+
+	if s.S.Has(owner, hashedKey) {
+		logger.Infof("serving shared file (%s) from local disk", key)
+		_, r, err := s.S.Read(owner, hashedKey)
+		if err != nil {
+			return nil, err
+		}
+		if fi, err := s.S.Stat(owner, hashedKey); err == nil && len(fi.Chunks) > 0 {
+			if rc, ok := r.(io.Closer); ok {
+				defer rc.Close()
+			}
+			return s.openChunked(r, nil, s.ShareIdentity)
+		}
+		return s.decryptShared(r, nil), nil
+	}
+
+	peers := s.replicas(owner, hashedKey)
+	if len(peers) == 0 {
+		// None of the replicas is connected, ask the network who holds it.
+		peers = s.holderPeers(owner, hashedKey)
+	}
+	holders, err := s.probe(peers, owner, hashedKey, ConsistencyOne.required(len(peers)))
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, h := range s.rankHolders(holders, hashedKey) {
+		stream, header, err := s.openFile(h, owner, hashedKey)
+		if err != nil {
+			logger.Warnf("fetching shared file (%s) from peer (%s) failed: %s", key, peerKey(h.peer), err)
+			errs = append(errs, err)
+			continue
+		}
+		if !header.Chunked {
+			return s.decryptShared(io.LimitReader(stream, header.Size), stream), nil
+		}
+
+		r, err := s.openChunked(io.LimitReader(stream, header.Size), h.peer, s.ShareIdentity)
+		if err != nil {
+			stream.Reset()
+			logger.Warnf("fetching shared file (%s) from peer (%s) failed: %s", key, peerKey(h.peer), err)
+			errs = append(errs, err)
+			continue
+		}
+		stream.Close()
+		return r, nil
+	}
+	return nil, fmt.Errorf("no peer could serve shared file (%s) of (%s): %w", key, owner, errors.Join(errs...))
+}
+
+// decryptShared decrypts r on the fly. stream, if any, is closed once r has
+// been consumed.
+func (s *FileServer) decryptShared(r io.Reader, stream p2p.Stream) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := gcrypto.CopyDecryptWith(r, pw, s.ShareIdentity)
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		if stream != nil {
+			if err != nil {
+				stream.Reset()
+			} else {
+				stream.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+	"github.com/jekki/gdss/p2p"
+	"github.com/jekki/gdss/store"
+)
+
+// storeStallTimeout is how long replicating a file may wait on a peer that
+// does not take any data or acknowledge it before the peer is given up.
+var storeStallTimeout = 30 * time.Second
+
+// maxDataFrame bounds the frames of files replicated without a declared
+// size.
+const maxDataFrame = 1 << 20
+
+// readerSize returns how many bytes r yields, or -1 if that is not known
+// without reading it.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - offset
+	}
+	return -1
+}
+
+// replicate encrypts what r yields for recipients and writes it to every
+// stream at once, then waits until needed of the receivers acknowledged
+// storing it. Streams of a file without a declared size are framed, see
+// frameWriter. Writes block while any peer lags behind, so only a fixed
+// amount of data is in flight; peers that fail or stop taking data for
+// storeStallTimeout are left out, which only fails the transfer once fewer
+// than needed remain.
+func (s *FileServer) replicate(r io.Reader, streams []p2p.Stream, recipients []gcrypto.Recipient, sized bool, needed int) (int64, error) {
+	fan := newFanout(streams, needed)
+	done := make(chan struct{})
+	go fan.watch(done)
+
+	var (
+		h             = sha256.New()
+		dst io.Writer = fan
+		fw  *frameWriter
+	)
+	if !sized {
+		fw = newFrameWriter(fan)
+		dst = fw
+	}
+	n, err := gcrypto.CopyEncryptTo(r, io.MultiWriter(h, dst), recipients...)
+	if err == nil && fw != nil {
+		err = fw.Close()
+	}
+	close(done)
+	if err != nil {
+		resetStreams(streams)
+		return 0, err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	results := make(chan error, len(streams))
+	for i, stream := range streams {
+		if fan.errs[i] != nil {
+			results <- fan.errs[i]
+			continue
+		}
+		go func(stream p2p.Stream) {
+			err := readAck(stream, int64(n), digest)
+			if err != nil {
+				stream.Reset()
+				err = fmt.Errorf("stream %d: %w", stream.ID(), s.failure(stream, err))
+			}
+			results <- err
+		}(stream)
+	}
+	if _, err := waitQuorum(results, len(streams), needed); err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// fanout writes to several streams at once. Streams that fail are reset
+// and left out; writes only fail once fewer than needed streams remain.
+type fanout struct {
+	streams []p2p.Stream
+	errs    []error
+	needed  int
+
+	mu sync.Mutex
+	// current is the stream being written since since, -1 if none.
+	current int
+	since   time.Time
+}
+
+func newFanout(streams []p2p.Stream, needed int) *fanout {
+	return &fanout{streams: streams, errs: make([]error, len(streams)), needed: needed, current: -1}
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	return f.writeTo(p, nil)
+}
+
+// writeTo is Write to only those streams want returns true for, or to all
+// of them if want is nil.
+func (f *fanout) writeTo(p []byte, want func(i int) bool) (int, error) {
+	live := 0
+	for i, stream := range f.streams {
+		if f.errs[i] != nil {
+			continue
+		}
+		if want != nil && !want(i) {
+			live++
+			continue
+		}
+		f.mark(i)
+		_, err := stream.Write(p)
+		f.mark(-1)
+		if err != nil {
+			f.fail(i, err)
+			continue
+		}
+		live++
+	}
+	if live < f.needed {
+		return 0, fmt.Errorf("%w: %d of %d peers left, %d needed: %w", ErrQuorum, live, len(f.streams), f.needed, errors.Join(f.errs...))
+	}
+	return len(p), nil
+}
+
+// fail leaves out stream i of f, which failed with err.
+func (f *fanout) fail(i int, err error) {
+	f.streams[i].Reset()
+	f.errs[i] = fmt.Errorf("stream %d: %w", f.streams[i].ID(), err)
+}
+
+func (f *fanout) mark(i int) {
+	f.mu.Lock()
+	f.current = i
+	f.since = time.Now()
+	f.mu.Unlock()
+}
+
+// watch resets the stream being written once the write lasts
+// storeStallTimeout, until done is closed.
+func (f *fanout) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(storeStallTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.current >= 0 && time.Since(f.since) >= storeStallTimeout {
+				f.streams[f.current].Reset()
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// dataTrailer follows the frames of a file replicated without a declared
+// size.
+type dataTrailer struct {
+	Size   int64
+	Digest [sha256.Size]byte
+}
+
+// frameWriter writes data as [u32 length][data] frames. Close writes an
+// empty frame and the dataTrailer describing everything written, which the
+// receiver checks the data against.
+type frameWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	n    int64
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{w: w, hash: sha256.New()}
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		frame := p
+		if len(frame) > maxDataFrame {
+			frame = frame[:maxDataFrame]
+		}
+		if err := writeChunkFrame(w.w, frame); err != nil {
+			return written, err
+		}
+		w.hash.Write(frame)
+		w.n += int64(len(frame))
+		written += len(frame)
+		p = p[len(frame):]
+	}
+	return written, nil
+}
+
+func (w *frameWriter) Close() error {
+	trailer := dataTrailer{Size: w.n}
+	copy(trailer.Digest[:], w.hash.Sum(nil))
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	binary.Write(buf, binary.LittleEndian, trailer)
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+// frameReader reads what a frameWriter wrote. It only returns io.EOF once
+// the data matches the trailer, and store.ErrMismatch otherwise.
+type frameReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+	// left is what remains of the current frame.
+	left uint32
+	err  error
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r, hash: sha256.New()}
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.left == 0 {
+		if err := binary.Read(r.r, binary.LittleEndian, &r.left); err != nil {
+			r.err = unexpected(err)
+			return 0, r.err
+		}
+		if r.left > maxDataFrame {
+			r.err = fmt.Errorf("frame of %d bytes exceeds the limit", r.left)
+			return 0, r.err
+		}
+		if r.left == 0 {
+			r.err = r.checkTrailer()
+			return 0, r.err
+		}
+	}
+
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	r.left -= uint32(n)
+	if err != nil {
+		r.err = unexpected(err)
+	}
+	return n, r.err
+}
+
+func (r *frameReader) checkTrailer() error {
+	var trailer dataTrailer
+	if err := binary.Read(r.r, binary.LittleEndian, &trailer); err != nil {
+		return unexpected(err)
+	}
+	if trailer.Size != r.n {
+		return fmt.Errorf("%w: received %d bytes, sent %d", store.ErrMismatch, r.n, trailer.Size)
+	}
+	if !bytes.Equal(trailer.Digest[:], r.hash.Sum(nil)) {
+		return fmt.Errorf("%w: received data differs from what was sent", store.ErrMismatch)
+	}
+	return io.EOF
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF, for streams that end
+// before their trailer.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// idleReader resets stream once reading from r makes no progress for
+// storeStallTimeout.
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func newIdleReader(r io.Reader, stream p2p.Stream) *idleReader {
+	return &idleReader{r: r, timer: time.AfterFunc(storeStallTimeout, func() { stream.Reset() })}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(storeStallTimeout)
+	return n, err
+}
+
+// Stop stops watching the stream.
+func (r *idleReader) Stop() {
+	r.timer.Stop()
+}
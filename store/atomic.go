@@ -0,0 +1,142 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// tempDirName is the folder in the root holding the temp files of writes in
+// progress, which are moved into place once complete. Objects live below
+// the folder of their owner, so no object is ever stored in it.
+const tempDirName = "tmp"
+
+// ErrMismatch is returned when written contents differ from what the writer
+// said to expect, e.g. because a transfer was cut short.
+var ErrMismatch = errors.New("store: written contents do not match what was expected")
+
+// createTemp creates a fresh temp file in dir whose name starts with
+// pattern.
+func createTemp(dir string, pattern string) (*os.File, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, pattern+".*")
+}
+
+// writeTemp writes what fill produces to a fresh temp file in dir and,
+// unless noSync is set, syncs it to disk. It returns the temp file's name
+// along with the size and the hex encoded SHA-256 digest of what was
+// written. On error no temp file is left behind.
+func writeTemp(dir string, pattern string, noSync bool, fill func(w io.Writer) (int64, error)) (string, int64, string, error) {
+	tmp, err := createTemp(dir, pattern)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	h := sha256.New()
+	n, err := fill(io.MultiWriter(tmp, h))
+	if err == nil && !noSync {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, "", err
+	}
+	return tmp.Name(), n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify checks a write against the expected size and digest. A negative
+// size and an empty digest are not checked.
+func verify(n int64, digest string, size int64, wantDigest string) error {
+	if size >= 0 && n != size {
+		return fmt.Errorf("%w: wrote %d bytes, expected %d", ErrMismatch, n, size)
+	}
+	if len(wantDigest) > 0 && digest != wantDigest {
+		return fmt.Errorf("%w: digest %s, expected %s", ErrMismatch, digest, wantDigest)
+	}
+	return nil
+}
+
+// commitTemp renames tmp to path and, unless noSync is set, syncs the
+// directory, so that after a crash path holds either its old or its new
+// contents.
+func commitTemp(tmp string, path string, noSync bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if noSync {
+		return nil
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeAtomic replaces the file at path with what fill produces, keeping it
+// only if it matches the expected size and digest (see verify). The temp
+// file is written in tempDir, which has to be on the same file system.
+// noSync skips syncing to disk, see DiskBackend.NoSync.
+func writeAtomic(tempDir string, path string, size int64, digest string, noSync bool, fill func(w io.Writer) (int64, error)) (int64, string, error) {
+	tmp, n, sum, err := writeTemp(tempDir, filepath.Base(path), noSync, fill)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := verify(n, sum, size, digest); err != nil {
+		os.Remove(tmp)
+		return 0, "", err
+	}
+	return n, sum, commitTemp(tmp, path, noSync)
+}
+
+// CleanTemp removes the temp files writes interrupted by a crash left
+// behind in the root, and in the root of a DiskBackend elsewhere. It must
+// not run while writes are in progress and returns how many files were
+// removed.
+func (s *Store) CleanTemp() (int, error) {
+	dirs := []string{filepath.Join(s.Root, tempDirName)}
+	if b, ok := s.Backend.(*DiskBackend); ok && filepath.Clean(b.Root) != filepath.Clean(s.Root) {
+		dirs = append(dirs, b.tempDir())
+	}
+
+	var removed int
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+// failingReader yields data and then fails like a dropped connection.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func countTemp(t *testing.T, root string) int {
+	entries, err := os.ReadDir(filepath.Join(root, tempDirName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestInterruptedWrite(t *testing.T) {
+	for _, contentAddressed := range []bool{false, true} {
+		s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc, ContentAddressed: contentAddressed})
+		id := gcrypto.GenerateID()
+
+		if _, err := s.Write(id, "key", &failingReader{data: []byte("partial")}); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+		if s.Has(id, "key") {
+			t.Errorf("expected an interrupted write to leave no file")
+		}
+
+		if _, err := s.Write(id, "key", bytes.NewReader([]byte("old data"))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Write(id, "key", &failingReader{data: []byte("new")}); err == nil {
+			t.Fatal("expected the write to fail")
+		}
+		_, r, err := s.Read(id, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(r)
+		if string(b) != "old data" {
+			t.Errorf("expected previous contents to survive, have %s", b)
+		}
+
+		if n := countTemp(t, s.Root); n != 0 {
+			t.Errorf("%d temp files left behind", n)
+		}
+	}
+}
+
+func TestWriteVerified(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+
+	// A transfer announced as longer than what arrived.
+	if _, err := s.WriteVerified(id, "key", bytes.NewReader(data), 100, ""); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+	if _, err := s.WriteVerified(id, "key", bytes.NewReader(data), -1, strings.Repeat("0", 64)); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+	if s.Has(id, "key") {
+		t.Errorf("expected a mismatching write to leave no file")
+	}
+
+	if _, err := s.WriteVerified(id, "key", bytes.NewReader(data), int64(len(data)), ""); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := s.Stat(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteVerified(id, "other", bytes.NewReader(data), int64(len(data)), fi.Digest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanTemp(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir()})
+	id := gcrypto.GenerateID()
+	// Keys may look like temp files.
+	for _, key := range []string{"key", "notes.tmp", "tmp"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("test data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// What a crash in the middle of a write leaves behind.
+	stale := filepath.Join(s.Root, tempDirName, "stale.123")
+	if err := os.WriteFile(stale, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.CleanTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("removed %d temp files", n)
+	}
+	for _, key := range []string{"key", "notes.tmp", "tmp"} {
+		if !s.Has(id, key) {
+			t.Errorf("expected stored file %s to survive", key)
+		}
+	}
+
+	var names []string
+	err = s.Backend.List(id+"/", func(obj ObjectInfo) error {
+		names = append(names, obj.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Errorf("expected the stored files to be listed, have %v", names)
+	}
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectInfo describes an object held by a Backend.
+type ObjectInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// Backend holds the objects a Store keeps files in. Object names are slash
+// separated paths. Missing objects are reported with errors wrapping
+// fs.ErrNotExist. Implementations must be safe for concurrent use.
+type Backend interface {
+	// Put stores what r yields under name, replacing any previous object.
+	// Unless r is read to its end without error, the previous object, if
+	// any, stays in place.
+	Put(name string, r io.Reader) (int64, error)
+	// Get opens the object stored under name, returning its size.
+	Get(name string) (int64, io.ReadCloser, error)
+	Has(name string) bool
+	// Delete removes the object stored under name. Deleting a missing
+	// object is not an error.
+	Delete(name string) error
+	Stat(name string) (ObjectInfo, error)
+	// List calls fn for every object whose name starts with prefix. An
+	// error returned by fn stops the listing and is returned.
+	List(prefix string, fn func(ObjectInfo) error) error
+}
+
+// Mover is implemented by backends that can rename objects without copying
+// them.
+type Mover interface {
+	Move(from string, to string) error
+}
+
+// move renames an object, copying it on backends that are no Mover.
+func move(b Backend, from string, to string) error {
+	if m, ok := b.(Mover); ok {
+		return m.Move(from, to)
+	}
+	return copyObject(b, from, to)
+}
+
+// copyObject moves an object by reading it and writing it under its new
+// name.
+func copyObject(b Backend, from string, to string) error {
+	_, r, err := b.Get(from)
+	if err != nil {
+		return err
+	}
+	_, err = b.Put(to, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return b.Delete(from)
+}
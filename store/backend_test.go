@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func readObject(t *testing.T, b Backend, name string) string {
+	n, r, err := b.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != n {
+		t.Errorf("%s: got size %d for %d bytes", name, n, len(data))
+	}
+	return string(data)
+}
+
+func testBackend(t *testing.T, b Backend) {
+	for _, name := range []string{"a/b/one", "a/b/two", "a/c", "b"} {
+		if _, err := b.Put(name, strings.NewReader("data of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := readObject(t, b, "a/b/one"); got != "data of a/b/one" {
+		t.Errorf("got %q", got)
+	}
+	if !b.Has("a/c") || b.Has("a/b") {
+		t.Errorf("expected only stored objects to exist")
+	}
+	if info, err := b.Stat("b"); err != nil || info.Size != int64(len("data of b")) {
+		t.Errorf("stat b: %+v, %v", info, err)
+	}
+	if _, _, err := b.Get("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	var names []string
+	err := b.List("a/b", func(info ObjectInfo) error {
+		names = append(names, info.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a/b/one,a/b/two" {
+		t.Errorf("listed %v", names)
+	}
+
+	// A failed Put leaves the previous object in place.
+	if _, err := b.Put("a/c", &failingReader{data: []byte("partial")}); err == nil {
+		t.Errorf("expected Put to fail")
+	}
+	if got := readObject(t, b, "a/c"); got != "data of a/c" {
+		t.Errorf("got %q after failed Put", got)
+	}
+
+	if _, err := b.Put("a/c", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, b, "a/c"); got != "replaced" {
+		t.Errorf("got %q after replacing", got)
+	}
+
+	if err := move(b, "a/c", "d/c"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Has("a/c") || readObject(t, b, "d/c") != "replaced" {
+		t.Errorf("expected object to be moved")
+	}
+
+	for _, name := range []string{"a/b/one", "missing"} {
+		if err := b.Delete(name); err != nil {
+			t.Errorf("delete %s: %v", name, err)
+		}
+	}
+	if b.Has("a/b/one") || !b.Has("a/b/two") {
+		t.Errorf("expected only the deleted object to be gone")
+	}
+}
+
+func TestDiskBackend(t *testing.T) {
+	testBackend(t, NewDiskBackend(t.TempDir()))
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestPackBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pack")
+	b, err := OpenPackBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBackend(t, b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of a Put.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(packRecord(packOpPut, "torn", packPending, fi.ModTime()))
+	f.Write([]byte("half of"))
+	f.Close()
+
+	b, err = OpenPackBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.Has("torn") || b.Has("a/b/one") {
+		t.Errorf("expected torn and deleted objects to be gone")
+	}
+	if got := readObject(t, b, "d/c"); got != "replaced" {
+		t.Errorf("got %q after reopening", got)
+	}
+	if fi2, err := os.Stat(path); err != nil || fi2.Size() != fi.Size() {
+		t.Errorf("expected torn record to be truncated")
+	}
+}
+
+// blockingReader yields data once release is closed.
+type blockingReader struct {
+	data    io.Reader
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.release
+	return r.data.Read(p)
+}
+
+func TestPackBackendSlowWriter(t *testing.T) {
+	b, err := OpenPackBackend(filepath.Join(t.TempDir(), "pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// A large object is spooled to a temp file first.
+	large := bytes.Repeat([]byte("x"), packSpoolSize+10)
+	slow := &blockingReader{data: bytes.NewReader(large), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Put("slow", slow)
+		done <- err
+	}()
+
+	// Other writes go ahead while the slow one waits for its data.
+	put := make(chan error, 1)
+	go func() {
+		_, err := b.Put("fast", strings.NewReader("data of fast"))
+		put <- err
+	}()
+	select {
+	case err := <-put:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked by a slow writer")
+	}
+	if err := b.Delete("fast"); err != nil {
+		t.Fatal(err)
+	}
+
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, b, "slow"); got != string(large) {
+		t.Errorf("got %d bytes of the slow object", len(got))
+	}
+}
+
+func TestStoreMemoryBackend(t *testing.T) {
+	for _, contentAddressed := range []bool{false, true} {
+		s := NewStore(StoreOpts{
+			PathTransformFunc: CASPathTransformFunc,
+			ContentAddressed:  contentAddressed,
+			Backend:           NewMemoryBackend(),
+		})
+		id := gcrypto.GenerateID()
+		data := []byte("some data")
+
+		if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := s.Read(id, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(r); !bytes.Equal(b, data) {
+			t.Errorf("got %q", b)
+		}
+		if fi, err := s.Stat(id, "key"); err != nil || fi.Size != int64(len(data)) {
+			t.Errorf("stat: %+v, %v", fi, err)
+		}
+
+		if err := s.RebuildIndex(); err != nil {
+			t.Fatal(err)
+		}
+		if page, err := s.List(id, "", "", 10); err != nil || len(page.Files) != 1 {
+			t.Errorf("listed %+v: %v", page, err)
+		}
+
+		if err := s.Delete(id, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if s.Has(id, "key") {
+			t.Errorf("expected key to be deleted")
+		}
+		if len(s.Root) != 0 {
+			t.Errorf("expected no root, got %s", s.Root)
+		}
+	}
+}
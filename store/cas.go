@@ -0,0 +1,225 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// blobsDirName is the folder in the root holding the contents of a content
+// addressed store.
+const blobsDirName = "blobs"
+
+// ErrCorrupt is returned when stored contents no longer match their digest.
+var ErrCorrupt = errors.New("store: contents do not match their digest")
+
+// stagingPrefix starts the names of blobs that are still being written.
+const stagingPrefix = blobsDirName + "/staging-"
+
+// stagingMaxAge is how old a staging blob or a chunk no manifest refers to
+// has to be before PruneBlobs assumes its write was interrupted.
+const stagingMaxAge = time.Hour
+
+func blobName(digest string) string {
+	return blobsDirName + "/" + digestPathKey(digest).FullPath()
+}
+
+// digestOf returns the digest the contents of key are stored under.
+func (s *Store) digestOf(id string, key string) (string, error) {
+	digest, err := s.readDigest(s.objectName(id, key))
+	if err != nil {
+		return "", err
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 2*sha256.Size {
+		return "", fmt.Errorf("%w: invalid digest for key %s", ErrCorrupt, key)
+	}
+	return digest, nil
+}
+
+// readDigest reads the digest a ref object refers to.
+func (s *Store) readDigest(name string) (string, error) {
+	_, r, err := s.Backend.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *Store) hasContent(id string, key string) bool {
+	digest, err := s.digestOf(id, key)
+	if err != nil {
+		return false
+	}
+	return s.Backend.Has(blobName(digest))
+}
+
+func (s *Store) readContent(id string, key string) (int64, io.ReadCloser, error) {
+	digest, err := s.digestOf(id, key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	name := blobName(digest)
+	n, r, err := s.Backend.Get(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, &verifyingReader{r: r, name: name, hash: sha256.New(), digest: digest}, nil
+}
+
+// writeContent stores what fill writes as a blob and points key at it. If
+// fill fails or its output is not what was expected, nothing is stored.
+func (s *Store) writeContent(id string, key string, size int64, digest string, chunks []string, fill func(w io.Writer) (int64, error)) (int64, error) {
+	// The digest is only known once the contents are written, so they are
+	// staged under a name of their own first.
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return 0, err
+	}
+	staging := stagingPrefix + hex.EncodeToString(nonce[:])
+
+	n, sum, err := s.put(staging, size, digest, fill)
+	if err != nil {
+		return 0, err
+	}
+
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+
+	if err := s.checkChunks(key, chunks); err != nil {
+		s.Backend.Delete(staging)
+		return 0, err
+	}
+	blob := blobName(sum)
+	if s.Backend.Has(blob) {
+		if err := s.Backend.Delete(staging); err != nil {
+			return 0, err
+		}
+	} else if err := move(s.Backend, staging, blob); err != nil {
+		s.Backend.Delete(staging)
+		return 0, err
+	}
+
+	if _, err := s.Backend.Put(s.objectName(id, key), strings.NewReader(sum+"\n")); err != nil {
+		return 0, err
+	}
+	return n, s.recordWrite(id, key, n, sum, chunks)
+}
+
+// removeBlobIfUnused removes the blob with digest unless the index knows of
+// a key still referring to it.
+func (s *Store) removeBlobIfUnused(digest string) error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+	if idx.referenced(digest) {
+		return nil
+	}
+	return s.Backend.Delete(blobName(digest))
+}
+
+// PruneBlobs removes the blobs of a content addressed store no key refers
+// to anymore, e.g. ones Delete kept because the index was incomplete, and
+// returns how many were removed. Blobs left behind by interrupted writes
+// are removed as well, and so are the chunks of any store no manifest the
+// index knows of refers to, e.g. ones of a transfer that failed before
+// its manifest was written.
+func (s *Store) PruneBlobs() (int, error) {
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+
+	var unused []string
+	if s.ContentAddressed {
+		blobs, err := s.unusedBlobs()
+		if err != nil {
+			return 0, err
+		}
+		unused = append(unused, blobs...)
+	}
+	chunks, err := s.unusedChunks()
+	if err != nil {
+		return 0, err
+	}
+	unused = append(unused, chunks...)
+
+	var pruned int
+	for _, name := range unused {
+		if err := s.Backend.Delete(name); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// unusedBlobs returns the names of the blobs no key refers to and of stale
+// staging blobs.
+func (s *Store) unusedBlobs() ([]string, error) {
+	referenced := make(map[string]bool)
+	err := s.Backend.List("", func(obj ObjectInfo) error {
+		if _, _, ok := splitObjectName(obj.Name); !ok {
+			return nil
+		}
+		digest, err := s.readDigest(obj.Name)
+		if err != nil {
+			return err
+		}
+		referenced[digest] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	err = s.Backend.List(blobsDirName+"/", func(obj ObjectInfo) error {
+		if strings.HasPrefix(obj.Name, stagingPrefix) {
+			// Recent ones belong to writes in progress.
+			if time.Since(obj.Modified) > stagingMaxAge {
+				unused = append(unused, obj.Name)
+			}
+			return nil
+		}
+		if !referenced[path.Base(obj.Name)] {
+			unused = append(unused, obj.Name)
+		}
+		return nil
+	})
+	return unused, err
+}
+
+// verifyingReader reads a blob and fails with ErrCorrupt at its end if the
+// contents do not hash to the digest it is stored under.
+type verifyingReader struct {
+	r      io.ReadCloser
+	name   string
+	hash   hash.Hash
+	digest string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.digest {
+		return n, fmt.Errorf("%w: %s", ErrCorrupt, r.name)
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func newContentAddressedStore(t *testing.T) *Store {
+	return NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		ContentAddressed:  true,
+	})
+}
+
+func TestContentAddressedDedup(t *testing.T) {
+	s := newContentAddressedStore(t)
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	da, err := s.digestOf(id, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := s.digestOf(id, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if da != db {
+		t.Errorf("expected identical contents to share a blob: %s, %s", da, db)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if !s.Has(id, key) {
+			t.Errorf("expected to have key %s", key)
+		}
+		_, r, err := s.Read(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(data) {
+			t.Errorf("want %s have %s", data, b)
+		}
+	}
+
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, "b") {
+		t.Errorf("expected blob to be kept for key b")
+	}
+	if err := s.Delete(id, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Backend.Has(blobName(da)) {
+		t.Errorf("expected blob to be removed with its last key")
+	}
+}
+
+func TestPruneBlobs(t *testing.T) {
+	s := newContentAddressedStore(t)
+	id := gcrypto.GenerateID()
+
+	for _, key := range []string{"kept", "orphan"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Lose the reference to a blob behind the index's back.
+	if err := s.Backend.Delete(s.objectName(id, "orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.PruneBlobs(); err != nil || n != 1 {
+		t.Errorf("pruned %d blobs: %v", n, err)
+	}
+	if !s.Has(id, "kept") {
+		t.Errorf("expected referenced blob to be kept")
+	}
+}
+
+func TestContentAddressedConcurrentDelete(t *testing.T) {
+	s := newContentAddressedStore(t)
+	id := gcrypto.GenerateID()
+	data := []byte("shared")
+
+	// Deleting one key must not take the blob away from another one that
+	// is written at the same time.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Write(id, "b", bytes.NewReader(data))
+			s.Delete(id, "b")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := s.Write(id, "a", bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if !s.Has(id, "a") {
+			t.Fatal("expected the blob of key a to be kept")
+		}
+		if err := s.Delete(id, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestContentAddressedCorrupt(t *testing.T) {
+	s := newContentAddressedStore(t)
+	id := gcrypto.GenerateID()
+
+	if _, err := s.Write(id, "key", bytes.NewReader([]byte("test data"))); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := s.digestOf(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Backend.Put(blobName(digest), strings.NewReader("tampered")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+}
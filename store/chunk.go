@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// chunksDirName is the folder in the root holding the chunks manifests
+// refer to.
+const chunksDirName = "chunks"
+
+func chunkName(digest string) string {
+	return chunksDirName + "/" + digestPathKey(digest).FullPath()
+}
+
+// HasChunk reports whether the chunk with the hex encoded SHA-256 digest is
+// stored.
+func (s *Store) HasChunk(digest string) bool {
+	return s.Backend.Has(chunkName(digest))
+}
+
+// WriteChunk stores data as the chunk with digest, failing with ErrMismatch
+// unless data has that digest. Chunks are shared by every manifest that
+// refers to them, so storing one again is a no-op.
+func (s *Store) WriteChunk(digest string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != digest {
+		return fmt.Errorf("%w: chunk %s", ErrMismatch, digest)
+	}
+	if s.HasChunk(digest) {
+		return nil
+	}
+	_, err := s.Backend.Put(chunkName(digest), bytes.NewReader(data))
+	return err
+}
+
+// ReadChunk returns the chunk with digest, failing with ErrCorrupt if it no
+// longer has that digest.
+func (s *Store) ReadChunk(digest string) ([]byte, error) {
+	_, r, err := s.Backend.Get(chunkName(digest))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("%w: chunk %s", ErrCorrupt, digest)
+	}
+	return data, nil
+}
+
+// WriteManifest is WriteVerified for a manifest referring to chunks, which
+// have to be stored with WriteChunk first. The chunks are kept as long as
+// a manifest refers to them and removed along with the last one.
+func (s *Store) WriteManifest(id string, key string, r io.Reader, size int64, chunks []string) (int64, error) {
+	if err := s.checkChunks(key, chunks); err != nil {
+		return 0, err
+	}
+	// Chunks are held on to while the manifest is written, so it is read
+	// in full first rather than at the pace of r.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	return s.write(id, key, size, "", chunks, func(w io.Writer) (int64, error) {
+		return io.Copy(w, bytes.NewReader(data))
+	})
+}
+
+// checkChunks fails unless all chunks the manifest of key refers to are
+// stored.
+func (s *Store) checkChunks(key string, chunks []string) error {
+	for _, c := range chunks {
+		if !s.HasChunk(c) {
+			return fmt.Errorf("manifest of key %s refers to missing chunk %s", key, c)
+		}
+	}
+	return nil
+}
+
+// unusedChunks returns the names of the chunks no manifest refers to that
+// are older than stagingMaxAge, younger ones may belong to a transfer whose
+// manifest is still to come.
+func (s *Store) unusedChunks() ([]string, error) {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	var digests []string
+	err = s.Backend.List(chunksDirName+"/", func(obj ObjectInfo) error {
+		if time.Since(obj.Modified) > stagingMaxAge {
+			digest := path.Base(obj.Name)
+			names[digest] = obj.Name
+			digests = append(digests, digest)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unused []string
+	for _, c := range idx.unreferencedChunks(digests) {
+		unused = append(unused, names[c])
+	}
+	return unused, nil
+}
+
+// removeChunks removes those of chunks no manifest refers to anymore.
+func (s *Store) removeChunks(chunks []string) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+	for _, c := range idx.unreferencedChunks(chunks) {
+		if err := s.Backend.Delete(chunkName(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func chunkDigest(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifestChunks(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	shared, a, b := chunkDigest("shared"), chunkDigest("a"), chunkDigest("b")
+
+	if err := s.WriteChunk(shared, []byte("other")); !errors.Is(err, ErrMismatch) {
+		t.Errorf("expected ErrMismatch, got %v", err)
+	}
+	if _, err := s.WriteManifest(id, "a", strings.NewReader("manifest a"), -1, []string{shared, a}); err == nil {
+		t.Errorf("expected manifest with missing chunks to be refused")
+	}
+
+	for _, data := range []string{"shared", "a", "b"} {
+		if err := s.WriteChunk(chunkDigest(data), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, chunks := range map[string][]string{"a": {shared, a}, "b": {shared, b, b}} {
+		if _, err := s.WriteManifest(id, key, strings.NewReader("manifest "+key), -1, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := s.Stat(id, "b"); err != nil || len(fi.Chunks) != 3 {
+		t.Errorf("stat: %+v, %v", fi, err)
+	}
+
+	if err := s.Delete(id, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasChunk(a) || !s.HasChunk(shared) {
+		t.Errorf("expected only the chunks of a alone to be removed")
+	}
+	if data, err := s.ReadChunk(shared); err != nil || string(data) != "shared" {
+		t.Errorf("read %q: %v", data, err)
+	}
+
+	// Replacing a manifest releases the chunks it no longer refers to.
+	if _, err := s.WriteManifest(id, "b", strings.NewReader("manifest b"), -1, []string{b}); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasChunk(shared) || !s.HasChunk(b) {
+		t.Errorf("expected chunks of the replaced manifest to be released")
+	}
+}
+
+func TestPruneChunks(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	kept, orphan, fresh := chunkDigest("kept"), chunkDigest("orphan"), chunkDigest("fresh")
+
+	for _, data := range []string{"kept", "orphan", "fresh"} {
+		if err := s.WriteChunk(chunkDigest(data), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.WriteManifest(id, "key", strings.NewReader("manifest"), -1, []string{kept}); err != nil {
+		t.Fatal(err)
+	}
+	// The manifest of orphan never arrived.
+	old := time.Now().Add(-2 * stagingMaxAge)
+	for _, digest := range []string{kept, orphan} {
+		if err := os.Chtimes(filepath.Join(root, chunkName(digest)), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := s.PruneBlobs(); err != nil || n != 1 {
+		t.Errorf("pruned %d: %v", n, err)
+	}
+	if s.HasChunk(orphan) {
+		t.Error("expected the unreferenced chunk to be pruned")
+	}
+	if !s.HasChunk(kept) || !s.HasChunk(fresh) {
+		t.Error("expected referenced and recent chunks to be kept")
+	}
+}
+
+func TestManifestConcurrentDelete(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	shared := chunkDigest("shared")
+
+	// A manifest is either refused or keeps its chunks, even if another
+	// one referring to them is deleted at the same time.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.WriteChunk(shared, []byte("shared"))
+			s.WriteManifest(id, "b", strings.NewReader("manifest b"), -1, []string{shared})
+			s.Delete(id, "b")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := s.WriteChunk(shared, []byte("shared")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.WriteManifest(id, "a", strings.NewReader("manifest a"), -1, []string{shared}); err != nil {
+			continue
+		}
+		if !s.HasChunk(shared) {
+			t.Fatal("expected the chunk of manifest a to be kept")
+		}
+		if err := s.Delete(id, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Default sizes of content defined chunks.
+const (
+	DefaultMinChunkSize = 256 << 10
+	DefaultAvgChunkSize = 1 << 20
+	DefaultMaxChunkSize = 4 << 20
+)
+
+// Chunker splits a stream into chunks.
+type Chunker interface {
+	// Next returns the next chunk, or io.EOF once the stream is consumed.
+	// The chunk is only valid until the next call. An empty stream yields
+	// a single empty chunk, so every stream has at least one.
+	Next() ([]byte, error)
+}
+
+// ChunkerFunc returns a Chunker splitting r. Splitting the same stream
+// twice must yield the same chunks.
+type ChunkerFunc func(r io.Reader) Chunker
+
+// FixedChunking splits streams into chunks of size bytes. An insertion
+// shifts all chunks after it, so only appended data deduplicates well.
+func FixedChunking(size int) ChunkerFunc {
+	return func(r io.Reader) Chunker {
+		return newChunker(r, size, func(data []byte) int {
+			return len(data)
+		})
+	}
+}
+
+// ContentDefinedChunking splits streams with FastCDC into chunks of min to
+// max bytes, avg bytes on average. Chunk boundaries depend on the data
+// around them only, so data shared by streams is found at any offset. It
+// panics if CheckChunkSizes rejects the sizes.
+func ContentDefinedChunking(min int, avg int, max int) ChunkerFunc {
+	if err := CheckChunkSizes(min, avg, max); err != nil {
+		panic(err)
+	}
+	// Normalized chunking: a harder condition before avg and an easier one
+	// after it keeps chunk sizes close to avg.
+	b := bits.Len(uint(avg)) - 1
+	maskS := ^uint64(0) << (64 - (b + 2))
+	maskL := ^uint64(0) << (64 - (b - 2))
+
+	return func(r io.Reader) Chunker {
+		return newChunker(r, max, func(data []byte) int {
+			n := len(data)
+			if n <= min {
+				return n
+			}
+			normal := avg
+			if n < normal {
+				normal = n
+			}
+
+			var fp uint64
+			i := min
+			for ; i < normal; i++ {
+				fp = fp<<1 + gear[data[i]]
+				if fp&maskS == 0 {
+					return i + 1
+				}
+			}
+			for ; i < n; i++ {
+				fp = fp<<1 + gear[data[i]]
+				if fp&maskL == 0 {
+					return i + 1
+				}
+			}
+			return n
+		})
+	}
+}
+
+// CheckChunkSizes returns an error unless ContentDefinedChunking can split
+// streams into chunks of min to max bytes, avg bytes on average.
+func CheckChunkSizes(min int, avg int, max int) error {
+	if min < 1 || avg < 64 || min > avg || avg > max {
+		return fmt.Errorf("store: invalid chunk sizes %d/%d/%d", min, avg, max)
+	}
+	return nil
+}
+
+// DefaultChunking is ContentDefinedChunking with the default sizes.
+var DefaultChunking = ContentDefinedChunking(DefaultMinChunkSize, DefaultAvgChunkSize, DefaultMaxChunkSize)
+
+// gear maps bytes to the random values the rolling hash of FastCDC adds up.
+// It is derived from a fixed seed, since nodes have to agree on chunk
+// boundaries to deduplicate each other's chunks.
+var gear = func() (table [256]uint64) {
+	for i := range table {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:])
+	}
+	return table
+}()
+
+// chunker buffers up to max bytes of a stream and lets cut pick where the
+// next chunk ends.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// The buffered data is buf[start:end].
+	start, end int
+	eof        bool
+	chunks     int
+	cut        func(data []byte) int
+}
+
+func newChunker(r io.Reader, max int, cut func(data []byte) int) *chunker {
+	return &chunker{r: r, buf: make([]byte, max), cut: cut}
+}
+
+func (c *chunker) fill() error {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < len(c.buf) {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		if c.chunks > 0 {
+			return nil, io.EOF
+		}
+		// An empty stream still gets its chunk.
+		c.chunks++
+		return data, nil
+	}
+
+	n := c.cut(data)
+	c.start += n
+	c.chunks++
+	return data[:n], nil
+}
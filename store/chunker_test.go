@@ -0,0 +1,81 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, chunking ChunkerFunc, data []byte) [][]byte {
+	var chunks [][]byte
+	c := chunking(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestFixedChunking(t *testing.T) {
+	for size, want := range map[int]int{0: 1, 1: 1, 100: 1, 101: 2, 1000: 10} {
+		chunks := chunkAll(t, FixedChunking(100), make([]byte, size))
+		if len(chunks) != want {
+			t.Errorf("%d bytes: got %d chunks, want %d", size, len(chunks), want)
+		}
+		if !bytes.Equal(bytes.Join(chunks, nil), make([]byte, size)) {
+			t.Errorf("%d bytes: chunks do not add up to the data", size)
+		}
+	}
+}
+
+func TestCheckChunkSizes(t *testing.T) {
+	if err := CheckChunkSizes(DefaultMinChunkSize, DefaultAvgChunkSize, DefaultMaxChunkSize); err != nil {
+		t.Errorf("default sizes: %v", err)
+	}
+	for _, sizes := range [][3]int{{0, 1024, 4096}, {256, 32, 4096}, {2048, 1024, 4096}, {256, 1024, 512}} {
+		if err := CheckChunkSizes(sizes[0], sizes[1], sizes[2]); err == nil {
+			t.Errorf("expected %v to be rejected", sizes)
+		}
+	}
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	chunking := ContentDefinedChunking(256, 1024, 4096)
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, chunking, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, c := range chunks {
+		if len(c) > 4096 || (len(c) < 256 && i != len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes", i, len(c))
+		}
+	}
+	if avg := len(data) / len(chunks); avg < 512 || avg > 2048 {
+		t.Errorf("chunks have %d bytes on average", avg)
+	}
+
+	// Inserting data only changes the chunks around it.
+	shifted := append(append(append([]byte(nil), data[:1000]...), "inserted"...), data[1000:]...)
+	known := make(map[string]bool)
+	for _, c := range chunks {
+		known[string(c)] = true
+	}
+	var changed int
+	for _, c := range chunkAll(t, chunking, shifted) {
+		if !known[string(c)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d chunks changed after an insertion", changed)
+	}
+}
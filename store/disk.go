@@ -0,0 +1,148 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskBackend keeps every object in a file of its own below Root, named
+// after the object. Objects are written atomically (see writeAtomic).
+type DiskBackend struct {
+	Root string
+	// NoSync skips syncing objects and folders to disk, which is much
+	// faster but may lose or tear objects written shortly before a crash.
+	// It is meant for tests and scratch data.
+	NoSync bool
+}
+
+// NewDiskBackend returns a DiskBackend storing objects below root.
+func NewDiskBackend(root string) *DiskBackend {
+	return &DiskBackend{Root: root}
+}
+
+func (b *DiskBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(name))
+}
+
+// tempDir returns the folder objects are written in before they are moved
+// into place.
+func (b *DiskBackend) tempDir() string {
+	return filepath.Join(b.Root, tempDirName)
+}
+
+func (b *DiskBackend) Put(name string, r io.Reader) (int64, error) {
+	n, _, err := writeAtomic(b.tempDir(), b.path(name), -1, "", b.NoSync, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+	return n, err
+}
+
+func (b *DiskBackend) Get(name string) (int64, io.ReadCloser, error) {
+	file, err := os.Open(b.path(name))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+
+	return fi.Size(), file, nil
+}
+
+// stat returns the file info of the object stored under name. Directories
+// are no objects.
+func (b *DiskBackend) stat(name string) (fs.FileInfo, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return fi, nil
+}
+
+func (b *DiskBackend) Has(name string) bool {
+	_, err := b.stat(name)
+	return err == nil
+}
+
+// Delete removes the file of the object along with the directories it
+// leaves empty.
+func (b *DiskBackend) Delete(name string) error {
+	path := b.path(name)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(path), filepath.Clean(b.Root))
+	return nil
+}
+
+func (b *DiskBackend) Stat(name string) (ObjectInfo, error) {
+	fi, err := b.stat(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: fi.Size(), Modified: fi.ModTime()}, nil
+}
+
+// List skips the temp files of writes in progress.
+func (b *DiskBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	// Only walk the directory the prefix points into.
+	dir := b.Root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = b.path(prefix[:i])
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err == nil && d.IsDir() && path == b.tempDir() {
+			return fs.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Name: name, Size: fi.Size(), Modified: fi.ModTime()})
+	})
+	return err
+}
+
+func (b *DiskBackend) Move(from string, to string) error {
+	to = b.path(to)
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(b.path(from), to); err != nil {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(b.path(from)), filepath.Clean(b.Root))
+	if b.NoSync {
+		return nil
+	}
+	return syncDir(filepath.Dir(to))
+}
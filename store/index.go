@@ -0,0 +1,479 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const indexFileName = "INDEX"
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	// ID is the node owning the file.
+	ID string `json:"id"`
+	// Key is the key the file was written under. It is empty for files
+	// found by RebuildIndex without an earlier record of them.
+	Key string `json:"key,omitempty"`
+	// Path is where the file is stored below the folder of its owner.
+	Path string `json:"path"`
+	// Size is the number of bytes stored.
+	Size int64 `json:"size"`
+	// Digest is the hex encoded SHA-256 digest of the stored bytes.
+	Digest  string    `json:"digest"`
+	Created time.Time `json:"created"`
+	// Attrs holds user supplied attributes, see SetAttrs.
+	Attrs map[string]string `json:"attrs,omitempty"`
+	// Chunks are the digests of the chunks a manifest refers to, see
+	// WriteManifest.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+const (
+	opPut     = "put"
+	opDelete  = "delete"
+	opBury    = "bury"
+	opCollect = "collect"
+)
+
+// indexRecord is one line of the index log.
+type indexRecord struct {
+	Op string `json:"op"`
+	FileInfo
+	// Deleted is when the file of a bury record was deleted.
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// index keeps the FileInfo of every stored file and the tombstones of
+// deleted ones in memory, backed by an append-only log of JSON records in
+// the root. The log is compacted when opened once most of its records are
+// outdated. An index without a path is only kept in memory.
+type index struct {
+	path string
+
+	lock       sync.Mutex
+	file       *os.File
+	records    int
+	entries    map[string]FileInfo
+	tombstones map[string]Tombstone
+}
+
+func indexKey(id string, path string) string {
+	return id + "/" + path
+}
+
+func openIndex(path string) (*index, error) {
+	idx := &index{
+		path:       path,
+		entries:    make(map[string]FileInfo),
+		tombstones: make(map[string]Tombstone),
+	}
+	if len(path) == 0 {
+		return idx, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		end := idx.load(f)
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		// Records appended after a torn one would be lost on the next load.
+		if end < fi.Size() {
+			if err := os.Truncate(path, end); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if idx.records > 2*(len(idx.entries)+len(idx.tombstones))+64 {
+		if err := idx.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	idx.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// load replays the records of the log. A record cut short by a crash ends
+// the log. It returns the offset of the end of the last record replayed.
+func (idx *index) load(r io.Reader) int64 {
+	var end int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// A last line without its newline was cut short.
+			return end
+		}
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return end
+		}
+		end += int64(len(line))
+		idx.records++
+
+		k := indexKey(rec.ID, rec.Path)
+		switch rec.Op {
+		case opPut:
+			idx.entries[k] = rec.FileInfo
+			delete(idx.tombstones, k)
+		case opDelete:
+			delete(idx.entries, k)
+		case opBury:
+			delete(idx.entries, k)
+			if rec.Deleted != nil {
+				idx.tombstones[k] = Tombstone{ID: rec.ID, Key: rec.Key, Path: rec.Path, Deleted: *rec.Deleted}
+			}
+		case opCollect:
+			delete(idx.tombstones, k)
+		}
+	}
+}
+
+func (idx *index) append(rec indexRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if idx.file == nil {
+		return nil
+	}
+	if _, err := idx.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	idx.records++
+	return nil
+}
+
+func (idx *index) put(fi FileInfo) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if err := idx.append(indexRecord{Op: opPut, FileInfo: fi}); err != nil {
+		return err
+	}
+	k := indexKey(fi.ID, fi.Path)
+	idx.entries[k] = fi
+	// The file is back, whatever deleted it before.
+	delete(idx.tombstones, k)
+	return nil
+}
+
+func (idx *index) bury(t Tombstone) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	rec := indexRecord{Op: opBury, FileInfo: FileInfo{ID: t.ID, Key: t.Key, Path: t.Path}, Deleted: &t.Deleted}
+	if err := idx.append(rec); err != nil {
+		return err
+	}
+	k := indexKey(t.ID, t.Path)
+	delete(idx.entries, k)
+	idx.tombstones[k] = t
+	return nil
+}
+
+func (idx *index) tombstone(id string, path string) (Tombstone, bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	t, ok := idx.tombstones[indexKey(id, path)]
+	return t, ok
+}
+
+// collect removes the tombstones of files deleted before before.
+func (idx *index) collect(before time.Time) (int, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	var collected int
+	for k, t := range idx.tombstones {
+		if !t.Deleted.Before(before) {
+			continue
+		}
+		if err := idx.append(indexRecord{Op: opCollect, FileInfo: FileInfo{ID: t.ID, Path: t.Path}}); err != nil {
+			return collected, err
+		}
+		delete(idx.tombstones, k)
+		collected++
+	}
+	return collected, nil
+}
+
+func (idx *index) delete(id string, path string) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	k := indexKey(id, path)
+	if _, ok := idx.entries[k]; !ok {
+		return nil
+	}
+	if err := idx.append(indexRecord{Op: opDelete, FileInfo: FileInfo{ID: id, Path: path}}); err != nil {
+		return err
+	}
+	delete(idx.entries, k)
+	return nil
+}
+
+func (idx *index) get(id string, path string) (FileInfo, bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	fi, ok := idx.entries[indexKey(id, path)]
+	return fi, ok
+}
+
+// referenced reports whether any entry has the given digest.
+func (idx *index) referenced(digest string) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	for _, fi := range idx.entries {
+		if fi.Digest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// unreferencedChunks returns those of chunks no manifest refers to.
+func (idx *index) unreferencedChunks(chunks []string) []string {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	referenced := make(map[string]bool)
+	for _, fi := range idx.entries {
+		for _, c := range fi.Chunks {
+			referenced[c] = true
+		}
+	}
+
+	var unreferenced []string
+	for _, c := range chunks {
+		if !referenced[c] {
+			unreferenced = append(unreferenced, c)
+			// Chunks can repeat within a manifest.
+			referenced[c] = true
+		}
+	}
+	return unreferenced
+}
+
+// rewrite replaces the log with one record per entry and tombstone.
+func (idx *index) rewrite() error {
+	if len(idx.path) == 0 {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, fi := range idx.entries {
+		if err := enc.Encode(indexRecord{Op: opPut, FileInfo: fi}); err != nil {
+			return err
+		}
+	}
+	for _, t := range idx.tombstones {
+		rec := indexRecord{Op: opBury, FileInfo: FileInfo{ID: t.ID, Key: t.Key, Path: t.Path}, Deleted: &t.Deleted}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	tempDir := filepath.Join(filepath.Dir(idx.path), tempDirName)
+	_, _, err := writeAtomic(tempDir, idx.path, -1, "", false, func(w io.Writer) (int64, error) {
+		return buf.WriteTo(w)
+	})
+	if err != nil {
+		return err
+	}
+	idx.records = len(idx.entries) + len(idx.tombstones)
+
+	// Keep appending to the new log.
+	if idx.file != nil {
+		idx.file.Close()
+		f, err := os.OpenFile(idx.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		idx.file = f
+	}
+	return nil
+}
+
+func (s *Store) openedIndex() (*index, error) {
+	s.indexOnce.Do(func() {
+		var path string
+		if len(s.Root) > 0 {
+			path = filepath.Join(s.Root, indexFileName)
+		}
+		s.index, s.indexErr = openIndex(path)
+	})
+	return s.index, s.indexErr
+}
+
+// recordWrite records a file just written under key in the index.
+func (s *Store) recordWrite(id string, key string, size int64, digest string, chunks []string) error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+
+	path := s.PathTransformFunc(key).FullPath()
+	fi := FileInfo{
+		ID:      id,
+		Key:     key,
+		Path:    path,
+		Size:    size,
+		Digest:  digest,
+		Created: time.Now().UTC(),
+		Chunks:  chunks,
+	}
+	// Rewriting a file keeps its attributes.
+	old, ok := idx.get(id, path)
+	if ok {
+		fi.Attrs = old.Attrs
+	}
+	if err := idx.put(fi); err != nil {
+		return err
+	}
+	return s.removeChunks(old.Chunks)
+}
+
+func (s *Store) recordDelete(id string, key string) error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+	return idx.delete(id, s.PathTransformFunc(key).FullPath())
+}
+
+// Stat returns the metadata recorded for the file stored under key.
+func (s *Store) Stat(id string, key string) (FileInfo, error) {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, ok := idx.get(id, s.PathTransformFunc(key).FullPath())
+	if !ok {
+		return FileInfo{}, fmt.Errorf("stat %s: %w", key, fs.ErrNotExist)
+	}
+	return fi, nil
+}
+
+// SetAttrs merges attrs into the attributes of the file stored under key.
+// An empty value removes an attribute.
+func (s *Store) SetAttrs(id string, key string, attrs map[string]string) error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+	fi, err := s.Stat(id, key)
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[string]string, len(fi.Attrs)+len(attrs))
+	for k, v := range fi.Attrs {
+		merged[k] = v
+	}
+	for k, v := range attrs {
+		if len(v) == 0 {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = v
+	}
+	fi.Attrs = merged
+	return idx.put(fi)
+}
+
+// RebuildIndex recreates the index from the stored files, e.g. after the
+// index was lost or files were moved by Migrate. Keys, creation times,
+// attributes and chunks are kept for files the index already knew about;
+// sizes and digests are taken from the backend. Manifests are opaque to the
+// store, so chunks are only tracked for manifests it already knew about.
+func (s *Store) RebuildIndex() error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]FileInfo)
+	err = s.Backend.List("", func(obj ObjectInfo) error {
+		id, path, ok := splitObjectName(obj.Name)
+		if !ok {
+			return nil
+		}
+		fi, err := s.scanFile(obj)
+		if err != nil {
+			return err
+		}
+		fi.ID = id
+		fi.Path = path
+		if old, ok := idx.get(fi.ID, fi.Path); ok {
+			fi.Key, fi.Created, fi.Attrs, fi.Chunks = old.Key, old.Created, old.Attrs, old.Chunks
+		}
+		entries[indexKey(fi.ID, fi.Path)] = fi
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.entries = entries
+	return idx.rewrite()
+}
+
+// scanFile returns the size and digest of the file stored as obj, which for
+// content addressed stores is the digest it refers to.
+func (s *Store) scanFile(obj ObjectInfo) (FileInfo, error) {
+	if s.ContentAddressed {
+		digest, err := s.readDigest(obj.Name)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		blob, err := s.Backend.Stat(blobName(digest))
+		if err != nil {
+			return FileInfo{}, err
+		}
+		return FileInfo{Size: blob.Size, Digest: digest, Created: blob.Modified.UTC()}, nil
+	}
+
+	_, r, err := s.Backend.Get(obj.Name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Size: n, Digest: hex.EncodeToString(h.Sum(nil)), Created: obj.Modified.UTC()}, nil
+}
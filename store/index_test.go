@@ -0,0 +1,145 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func TestStat(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+	sum := sha256.Sum256(data)
+
+	if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAttrs(id, "key", map[string]string{"content-type": "text/plain"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store opened later sees what was recorded before.
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	fi, err := s.Stat(id, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.ID != id || fi.Key != "key" || fi.Size != int64(len(data)) {
+		t.Errorf("unexpected file info %+v", fi)
+	}
+	if fi.Digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest: %s", fi.Digest)
+	}
+	if fi.Attrs["content-type"] != "text/plain" {
+		t.Errorf("attrs: %v", fi.Attrs)
+	}
+
+	if err := s.Delete(id, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(id, "key"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected deleted file to be gone from the index, got %v", err)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	for _, contentAddressed := range []bool{false, true} {
+		root := t.TempDir()
+		opts := StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc, ContentAddressed: contentAddressed}
+		s := NewStore(opts)
+		id := gcrypto.GenerateID()
+		data := []byte("test data")
+
+		for _, key := range []string{"kept", "lost"} {
+			if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.RebuildIndex(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := s.Stat(id, "kept")
+		if err != nil || fi.Key != "kept" || fi.Size != int64(len(data)) {
+			t.Errorf("kept: %+v, %v", fi, err)
+		}
+
+		// Without the index, files are found again but their keys are not.
+		if err := os.Remove(filepath.Join(root, indexFileName)); err != nil {
+			t.Fatal(err)
+		}
+		s = NewStore(opts)
+		if err := s.RebuildIndex(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err = s.Stat(id, "lost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Key != "" || fi.Size != int64(len(data)) || len(fi.Digest) != 64 {
+			t.Errorf("lost: %+v", fi)
+		}
+	}
+}
+
+func TestIndexTornRecord(t *testing.T) {
+	root := t.TempDir()
+	opts := StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc}
+	s := NewStore(opts)
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+
+	if _, err := s.Write(id, "before", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash while appending leaves half a record behind.
+	f, err := os.OpenFile(filepath.Join(root, indexFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(`{"op":"put","id":`)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s = NewStore(opts)
+	if _, err := s.Write(id, "after", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewStore(opts)
+	for _, key := range []string{"before", "after"} {
+		if _, err := s.Stat(id, key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestIndexRewriteCountsTombstones(t *testing.T) {
+	idx, err := openIndex(filepath.Join(t.TempDir(), indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.put(FileInfo{ID: "id", Path: "kept"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.bury(Tombstone{ID: "id", Path: "deleted", Deleted: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.rewrite(); err != nil {
+		t.Fatal(err)
+	}
+	if idx.records != 2 {
+		t.Errorf("expected 2 records after rewriting, counted %d", idx.records)
+	}
+}
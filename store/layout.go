@@ -0,0 +1,164 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jekki/gdss/log"
+)
+
+// Storage layout versions, recorded in the LAYOUT file of the root.
+const (
+	// LayoutLegacy stores keys under their SHA-1 digest. Roots written
+	// before the LAYOUT file existed use it.
+	LayoutLegacy = 1
+	// LayoutSHA256 stores keys under their SHA-256 digest.
+	LayoutSHA256 = 2
+	// CurrentLayout is the layout new roots are created with.
+	CurrentLayout = LayoutSHA256
+)
+
+const layoutFileName = "LAYOUT"
+
+// LayoutVersion returns the layout version of the root. A root that holds
+// stored files but no LAYOUT file predates it and uses LayoutLegacy. Stores
+// without a root always use CurrentLayout.
+func (s *Store) LayoutVersion() (int, error) {
+	if len(s.Root) == 0 {
+		return CurrentLayout, nil
+	}
+	b, err := os.ReadFile(filepath.Join(s.Root, layoutFileName))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return CurrentLayout, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != tempDirName {
+			return LayoutLegacy, nil
+		}
+	}
+	return CurrentLayout, nil
+}
+
+func (s *Store) writeLayout(version int) error {
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.Root, layoutFileName), []byte(strconv.Itoa(version)+"\n"), 0644)
+}
+
+// ensureLayout records the layout of a fresh root before its first file is
+// written, so it is not mistaken for a legacy root later on.
+func (s *Store) ensureLayout() {
+	s.layoutOnce.Do(func() {
+		if len(s.Root) == 0 {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(s.Root, layoutFileName)); err == nil {
+			return
+		}
+		version, err := s.LayoutVersion()
+		if err != nil || version != CurrentLayout {
+			return
+		}
+		if err := s.writeLayout(CurrentLayout); err != nil {
+			log.Errorf("writing storage layout of %s: %v", s.Root, err)
+		}
+	})
+}
+
+// Migrate moves files stored with the legacy path transform to where the
+// store's PathTransformFunc puts them now. Digests cannot be reversed, so
+// the caller supplies the keys files were stored under in the legacy layout,
+// mapped to the keys they are stored under now. It returns how many files
+// were moved and how many legacy files were left in place because their key
+// was not supplied, and marks the root as migrated. Only roots of a
+// DiskBackend can be migrated, legacy layouts predate the other backends.
+func (s *Store) Migrate(legacy PathTransformFunc, keys map[string]string) (int, int, error) {
+	if b, ok := s.Backend.(*DiskBackend); !ok || filepath.Clean(b.Root) != filepath.Clean(s.Root) {
+		return 0, 0, fmt.Errorf("store: only files on disk in %s can be migrated", s.Root)
+	}
+
+	ids, err := os.ReadDir(s.Root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, 0, s.writeLayout(CurrentLayout)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var migrated int
+	for _, id := range ids {
+		if !id.IsDir() || id.Name() == blobsDirName || id.Name() == chunksDirName || id.Name() == tempDirName {
+			continue
+		}
+		idRoot := filepath.Join(s.Root, id.Name())
+
+		for oldKey, newKey := range keys {
+			from := filepath.Join(idRoot, legacy(oldKey).FullPath())
+			if _, err := os.Stat(from); err != nil {
+				continue
+			}
+
+			to := filepath.Join(idRoot, s.PathTransformFunc(newKey).FullPath())
+			if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+				return migrated, 0, err
+			}
+			if err := os.Rename(from, to); err != nil {
+				return migrated, 0, err
+			}
+			removeEmptyDirs(filepath.Dir(from), idRoot)
+			migrated++
+		}
+	}
+
+	// Legacy file names are digests of a different length than current ones.
+	legacyLen := len(legacy("").Filename)
+	var remaining int
+	err = filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && len(d.Name()) == legacyLen {
+			remaining++
+		}
+		return nil
+	})
+	if err != nil {
+		return migrated, remaining, err
+	}
+
+	if remaining > 0 {
+		log.Warnf("%d files in %s could not be migrated, their keys are unknown", remaining, s.Root)
+	}
+	if err := s.RebuildIndex(); err != nil {
+		return migrated, remaining, err
+	}
+	return migrated, remaining, s.writeLayout(CurrentLayout)
+}
+
+// removeEmptyDirs removes dir and its parents for as long as they are empty,
+// stopping at stop.
+func removeEmptyDirs(dir string, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
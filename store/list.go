@@ -0,0 +1,86 @@
+package store
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NameAttr is the attribute holding the name a file is listed under, e.g.
+// the plain key of a file stored under a hashed one.
+const NameAttr = "name"
+
+// Name returns the name fi is listed under: its NameAttr if it has one, and
+// its key otherwise.
+func (fi FileInfo) Name() string {
+	if name, ok := fi.Attrs[NameAttr]; ok {
+		return name
+	}
+	return fi.Key
+}
+
+// ListPage is one page of List results.
+type ListPage struct {
+	Files []FileInfo
+	// Next is the cursor of the following page, empty on the last one.
+	Next string
+}
+
+// ListCursor returns the cursor pointing right after fi, which lets pages
+// from several sources be merged and continued.
+func ListCursor(fi FileInfo) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listSortKey(fi)))
+}
+
+func listSortKey(fi FileInfo) string {
+	return fi.ID + "\x00" + fi.Name() + "\x00" + fi.Path
+}
+
+// List returns the indexed files of the node id whose name starts with
+// prefix, see FileInfo.Name, ordered by owner, then name, then path. An
+// empty id lists the files of every node. Up to limit files following
+// cursor are returned; pass the Next cursor of a page to get the one after
+// it, and an empty cursor to start at the beginning.
+func (s *Store) List(id string, prefix string, cursor string, limit int) (ListPage, error) {
+	if limit <= 0 {
+		return ListPage{}, fmt.Errorf("invalid list limit %d", limit)
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ListPage{}, fmt.Errorf("invalid list cursor: %w", err)
+	}
+
+	idx, err := s.openedIndex()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	idx.lock.Lock()
+	var files []FileInfo
+	for _, fi := range idx.entries {
+		if len(id) > 0 && fi.ID != id {
+			continue
+		}
+		if !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		if len(after) > 0 && listSortKey(fi) <= string(after) {
+			continue
+		}
+		files = append(files, fi)
+	}
+	idx.lock.Unlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		return listSortKey(files[i]) < listSortKey(files[j])
+	})
+
+	var page ListPage
+	if len(files) > limit {
+		files = files[:limit]
+		page.Next = ListCursor(files[limit-1])
+	}
+	page.Files = files
+	return page, nil
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func TestList(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	other := gcrypto.GenerateID()
+
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{fmt.Sprintf("photos/%d", i), fmt.Sprintf("docs/%d", i)} {
+			if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := s.Write(other, "photos/other", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	cursor := ""
+	for {
+		page, err := s.List(id, "photos/", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range page.Files {
+			keys = append(keys, fi.Key)
+		}
+		if len(page.Next) == 0 {
+			break
+		}
+		cursor = page.Next
+	}
+
+	want := []string{"photos/0", "photos/1", "photos/2", "photos/3", "photos/4"}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("want %v have %v", want, keys)
+	}
+
+	page, err := s.List("", "photos/", "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Files) != 6 || len(page.Next) != 0 {
+		t.Errorf("listing every node: %d files, next %q", len(page.Files), page.Next)
+	}
+
+	if _, err := s.List(id, "", "not a cursor!", 2); err == nil {
+		t.Errorf("expected invalid cursor to be rejected")
+	}
+}
+
+func TestListByNameAttr(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+
+	if _, err := s.Write(id, "5d41402abc4b2a76", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAttrs(id, "5d41402abc4b2a76", map[string]string{NameAttr: "photos/a.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := s.List(id, "photos/", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Files) != 1 || page.Files[0].Name() != "photos/a.png" {
+		t.Errorf("expected the file to be listed by its name, got %+v", page.Files)
+	}
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps objects in memory, which suits tests and nodes that
+// only cache.
+type MemoryBackend struct {
+	lock    sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+// NewMemoryBackend returns an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]memoryObject)}
+}
+
+func (b *MemoryBackend) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.objects[name] = memoryObject{data: data, modified: time.Now()}
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) get(name string) (memoryObject, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	obj, ok := b.objects[name]
+	if !ok {
+		return memoryObject{}, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return obj, nil
+}
+
+func (b *MemoryBackend) Get(name string) (int64, io.ReadCloser, error) {
+	obj, err := b.get(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Objects are replaced, never modified, so readers can share the data.
+	return int64(len(obj.data)), io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (b *MemoryBackend) Has(name string) bool {
+	_, err := b.get(name)
+	return err == nil
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.objects, name)
+	return nil
+}
+
+func (b *MemoryBackend) Stat(name string) (ObjectInfo, error) {
+	obj, err := b.get(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: int64(len(obj.data)), Modified: obj.modified}, nil
+}
+
+// List lists objects in lexical order of their names.
+func (b *MemoryBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	b.lock.RLock()
+	var infos []ObjectInfo
+	for name, obj := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, ObjectInfo{Name: name, Size: int64(len(obj.data)), Modified: obj.modified})
+		}
+	}
+	b.lock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Move(from string, to string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	obj, ok := b.objects[from]
+	if !ok {
+		return fmt.Errorf("%s: %w", from, fs.ErrNotExist)
+	}
+	delete(b.objects, from)
+	b.objects[to] = obj
+	return nil
+}
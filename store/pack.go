@@ -0,0 +1,405 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pack file layout: a header followed by records appended one after the
+// other.
+//
+//	header: magic[4] | version[1]
+//	record: op[1] | name length[2] | data length[8] | modified[8] | name | data
+//
+// A put record is written with a pending data length that is only filled in
+// once all of its data is on disk, so a record cut short by a crash is
+// recognised and dropped when the pack is opened again.
+const (
+	packMagic       = "GDSP"
+	packVersion     = 1
+	packHeaderSize  = len(packMagic) + 1
+	packRecordSize  = 1 + 2 + 8 + 8
+	packPending     = ^uint64(0)
+	packOpPut       = 0x1
+	packOpDelete    = 0x2
+	packCompactSize = 64 << 20
+	// packSpoolSize is how much of an object Put buffers in memory before
+	// spooling the rest to a temp file.
+	packSpoolSize = 1 << 20
+)
+
+// PackBackend keeps all objects in a single append-only file, which avoids
+// one file and directory chain per object. Replaced and deleted objects
+// leave garbage behind that is compacted away when the pack is opened.
+// Writes are serialised, reads run concurrently. Objects are read in full
+// before they are appended, so a slow writer does not hold up the others.
+type PackBackend struct {
+	path string
+
+	// writeLock serialises appends, lock guards the fields below.
+	writeLock sync.Mutex
+	lock      sync.RWMutex
+	file      *os.File
+	size      int64
+	garbage   int64
+	objects   map[string]packObject
+}
+
+type packObject struct {
+	offset   int64
+	size     int64
+	modified time.Time
+}
+
+// OpenPackBackend opens the pack file at path, creating it if needed.
+func OpenPackBackend(path string) (*PackBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &PackBackend{
+		path:    path,
+		file:    f,
+		objects: make(map[string]packObject),
+	}
+	if err := b.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if b.garbage > packCompactSize && b.garbage > b.size/2 {
+		if err := b.compact(); err != nil {
+			b.file.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Close closes the pack file.
+func (b *PackBackend) Close() error {
+	return b.file.Close()
+}
+
+func (b *PackBackend) load() error {
+	fi, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		header := append([]byte(packMagic), packVersion)
+		if _, err := b.file.WriteAt(header, 0); err != nil {
+			return err
+		}
+		b.size = int64(len(header))
+		return b.file.Sync()
+	}
+
+	header := make([]byte, packHeaderSize)
+	if _, err := b.file.ReadAt(header, 0); err != nil || string(header[:len(packMagic)]) != packMagic {
+		return fmt.Errorf("%s: not a pack file", b.path)
+	}
+	if header[len(packMagic)] != packVersion {
+		return fmt.Errorf("%s: unsupported pack version %d", b.path, header[len(packMagic)])
+	}
+
+	offset := int64(packHeaderSize)
+	for offset < fi.Size() {
+		var rec [packRecordSize]byte
+		if _, err := b.file.ReadAt(rec[:], offset); err != nil {
+			break
+		}
+		op := rec[0]
+		nameLen := int64(binary.BigEndian.Uint16(rec[1:]))
+		dataLen := binary.BigEndian.Uint64(rec[3:])
+		modified := time.Unix(0, int64(binary.BigEndian.Uint64(rec[11:])))
+
+		dataOffset := offset + packRecordSize + nameLen
+		if dataLen == packPending || dataOffset+int64(dataLen) > fi.Size() {
+			break
+		}
+		name := make([]byte, nameLen)
+		if _, err := b.file.ReadAt(name, offset+packRecordSize); err != nil {
+			break
+		}
+
+		switch op {
+		case packOpPut:
+			b.replace(string(name), &packObject{offset: dataOffset, size: int64(dataLen), modified: modified})
+		case packOpDelete:
+			b.replace(string(name), nil)
+		default:
+			return fmt.Errorf("%s: invalid record at offset %d", b.path, offset)
+		}
+		offset = dataOffset + int64(dataLen)
+	}
+
+	// Drop whatever a crash left behind after the last complete record.
+	if offset < fi.Size() {
+		if err := b.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	b.size = offset
+	return nil
+}
+
+// replace points name at obj, or removes it if obj is nil, and accounts for
+// the garbage this leaves. Callers hold lock or have exclusive access.
+func (b *PackBackend) replace(name string, obj *packObject) {
+	if old, ok := b.objects[name]; ok {
+		b.garbage += packRecordSize + int64(len(name)) + old.size
+	}
+	if obj == nil {
+		delete(b.objects, name)
+		return
+	}
+	b.objects[name] = *obj
+}
+
+func packRecord(op uint8, name string, dataLen uint64, modified time.Time) []byte {
+	rec := make([]byte, packRecordSize, packRecordSize+len(name))
+	rec[0] = op
+	binary.BigEndian.PutUint16(rec[1:], uint16(len(name)))
+	binary.BigEndian.PutUint64(rec[3:], dataLen)
+	binary.BigEndian.PutUint64(rec[11:], uint64(modified.UnixNano()))
+	return append(rec, name...)
+}
+
+func (b *PackBackend) Put(name string, r io.Reader) (int64, error) {
+	if len(name) > 1<<16-1 {
+		return 0, fmt.Errorf("object name too long: %d bytes", len(name))
+	}
+
+	data, release, err := b.spool(r)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	b.lock.RLock()
+	offset := b.size
+	b.lock.RUnlock()
+
+	modified := time.Now()
+	rec := packRecord(packOpPut, name, packPending, modified)
+	if _, err := b.file.WriteAt(rec, offset); err != nil {
+		return 0, err
+	}
+
+	dataOffset := offset + int64(len(rec))
+	n, err := io.Copy(io.NewOffsetWriter(b.file, dataOffset), data)
+	if err == nil {
+		// The data has to be on disk before the length commits it, writes
+		// may otherwise reach the disk out of order.
+		err = b.file.Sync()
+	}
+	if err == nil {
+		// Commit the record by filling in its length.
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(n))
+		_, err = b.file.WriteAt(length[:], offset+3)
+	}
+	if err == nil {
+		err = b.file.Sync()
+	}
+	if err != nil {
+		b.file.Truncate(offset)
+		return 0, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.replace(name, &packObject{offset: dataOffset, size: n, modified: modified})
+	b.size = dataOffset + n
+	return n, nil
+}
+
+// spool reads r to its end. Small objects are kept in memory, larger ones in
+// a temp file next to the pack. It returns the data read along with a func
+// that releases it.
+func (b *PackBackend) spool(r io.Reader) (io.Reader, func(), error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, r, packSpoolSize+1); err == io.EOF {
+		return buf, func() {}, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	tmp, err := createTemp(filepath.Join(filepath.Dir(b.path), tempDirName), filepath.Base(b.path))
+	if err != nil {
+		return nil, nil, err
+	}
+	release := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, io.MultiReader(buf, r)); err != nil {
+		release()
+		return nil, nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		release()
+		return nil, nil, err
+	}
+	return tmp, release, nil
+}
+
+func (b *PackBackend) get(name string) (packObject, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	obj, ok := b.objects[name]
+	if !ok {
+		return packObject{}, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return obj, nil
+}
+
+func (b *PackBackend) Get(name string) (int64, io.ReadCloser, error) {
+	obj, err := b.get(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return obj.size, io.NopCloser(io.NewSectionReader(b.file, obj.offset, obj.size)), nil
+}
+
+func (b *PackBackend) Has(name string) bool {
+	_, err := b.get(name)
+	return err == nil
+}
+
+func (b *PackBackend) Delete(name string) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	if !b.Has(name) {
+		return nil
+	}
+
+	b.lock.RLock()
+	offset := b.size
+	b.lock.RUnlock()
+
+	rec := packRecord(packOpDelete, name, 0, time.Now())
+	if _, err := b.file.WriteAt(rec, offset); err != nil {
+		b.file.Truncate(offset)
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.replace(name, nil)
+	b.garbage += int64(len(rec))
+	b.size = offset + int64(len(rec))
+	return nil
+}
+
+func (b *PackBackend) Stat(name string) (ObjectInfo, error) {
+	obj, err := b.get(name)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: obj.size, Modified: obj.modified}, nil
+}
+
+// List lists objects in lexical order of their names.
+func (b *PackBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	b.lock.RLock()
+	var infos []ObjectInfo
+	for name, obj := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, ObjectInfo{Name: name, Size: obj.size, Modified: obj.modified})
+		}
+	}
+	b.lock.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact rewrites the pack with only the live objects. It runs while the
+// pack is opened, before any reader can hold on to the old file.
+func (b *PackBackend) compact() error {
+	old := b.objects
+	names := make([]string, 0, len(old))
+	for name := range old {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tmp, err := createTemp(filepath.Join(filepath.Dir(b.path), tempDirName), filepath.Base(b.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	objects := make(map[string]packObject, len(old))
+	offset := int64(packHeaderSize)
+	if _, err := tmp.Write(append([]byte(packMagic), packVersion)); err != nil {
+		tmp.Close()
+		return err
+	}
+	for _, name := range names {
+		obj := old[name]
+		rec := packRecord(packOpPut, name, uint64(obj.size), obj.modified)
+		if _, err := tmp.Write(rec); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.Copy(tmp, io.NewSectionReader(b.file, obj.offset, obj.size)); err != nil {
+			tmp.Close()
+			return err
+		}
+		objects[name] = packObject{offset: offset + int64(len(rec)), size: obj.size, modified: obj.modified}
+		offset += int64(len(rec)) + obj.size
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(b.path)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(b.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	b.file.Close()
+	b.file = f
+	b.objects = objects
+	b.size = offset
+	b.garbage = 0
+	return nil
+}
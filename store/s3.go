@@ -0,0 +1,474 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultS3PartSize is the part size of multipart uploads by default.
+const DefaultS3PartSize = 16 << 20
+
+// s3MinPartSize is the smallest part S3 takes, but for the last one.
+const s3MinPartSize = 5 << 20
+
+// s3MaxCopySize is the size of the largest object S3 copies in one request.
+const s3MaxCopySize = 5 << 30
+
+// S3Opts configures an S3Backend.
+type S3Opts struct {
+	// Endpoint is the base URL of the S3 compatible service, e.g.
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	// Buckets are addressed path-style.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is put in front of the names of all objects, so several stores
+	// can share a bucket.
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PartSize is how much of an object is buffered and uploaded at once.
+	// Objects larger than that are uploaded in parts. S3 requires parts of
+	// at least 5 MiB, NewS3Backend refuses smaller ones. It defaults to
+	// DefaultS3PartSize.
+	PartSize int64
+	Client   *http.Client
+}
+
+// S3Backend keeps objects in a bucket of an S3 compatible object storage.
+// Uploads are buffered one part at a time, so memory use is bounded by
+// PartSize per concurrent Put. Smaller objects only take the memory they
+// need.
+type S3Backend struct {
+	S3Opts
+}
+
+// NewS3Backend returns an S3Backend storing objects in opts.Bucket.
+func NewS3Backend(opts S3Opts) (*S3Backend, error) {
+	if len(opts.Endpoint) == 0 || len(opts.Bucket) == 0 {
+		return nil, fmt.Errorf("s3: endpoint and bucket are required")
+	}
+	if _, err := url.Parse(opts.Endpoint); err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %w", err)
+	}
+	opts.Endpoint = strings.TrimSuffix(opts.Endpoint, "/")
+	if len(opts.Region) == 0 {
+		opts.Region = "us-east-1"
+	}
+	opts.Prefix = strings.Trim(opts.Prefix, "/")
+	if len(opts.Prefix) > 0 {
+		opts.Prefix += "/"
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultS3PartSize
+	}
+	if opts.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3: part size %d is below the minimum of %d", opts.PartSize, s3MinPartSize)
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	return &S3Backend{S3Opts: opts}, nil
+}
+
+// s3Error is an error response of the service.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// Is reports missing objects as fs.ErrNotExist.
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func readS3Error(resp *http.Response) error {
+	e := &s3Error{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	xml.Unmarshal(b, e)
+	return e
+}
+
+// readS3Result reads the body of a response to a request that can still
+// fail after its status was sent, like completing an upload or copying.
+func readS3Result(resp *http.Response) error {
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		e := &s3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(b, e)
+		return e
+	}
+	return nil
+}
+
+// do sends a request for the object key, with key relative to the bucket,
+// and fails unless the response has a 2xx status.
+func (b *S3Backend) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := b.Endpoint + "/" + s3Escape(b.Bucket, false) + "/" + s3Escape(key, false)
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	b.sign(req, body, time.Now().UTC())
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp)
+	}
+	return resp, nil
+}
+
+// sign signs req with AWS Signature Version 4.
+func (b *S3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if len(b.AccessKey) == 0 {
+		// Anonymous access.
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "content-type" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	day := now.Format("20060102")
+	scope := day + "/" + b.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), day)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes s the way signatures expect it, keeping slashes unless
+// encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes query sorted by key, as signatures expect it.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Put uploads objects up to PartSize with a single request and larger ones
+// in parts. The object only changes once the upload is complete.
+func (b *S3Backend) Put(name string, r io.Reader) (int64, error) {
+	// Read one byte past the part to tell whether there is more to come.
+	buf := new(bytes.Buffer)
+	n, err := io.CopyN(buf, r, b.PartSize+1)
+	if err == io.EOF {
+		resp, err := b.do(http.MethodPut, b.Prefix+name, nil, nil, buf.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	data := buf.Bytes()
+	rest := io.MultiReader(bytes.NewReader([]byte{data[b.PartSize]}), r)
+	return b.putMultipart(name, data[:b.PartSize], rest)
+}
+
+// readPart fills buf from r, reporting whether r ended. Unlike with
+// io.ReadFull, errors of r are never mistaken for its end.
+func readPart(r io.Reader, buf []byte) (int, bool, error) {
+	var n int
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, true, nil
+		}
+		if err != nil {
+			return n, false, err
+		}
+	}
+	return n, false, nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads the full part in buf followed by the rest of r.
+func (b *S3Backend) putMultipart(name string, buf []byte, r io.Reader) (int64, error) {
+	key := b.Prefix + name
+	resp, err := b.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("s3: initiating upload of %s: %w", name, err)
+	}
+
+	n, err := b.uploadParts(key, initiated.UploadID, buf, r)
+	if err != nil {
+		// Drop the parts uploaded so far, the previous object stays.
+		if resp, err := b.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+func (b *S3Backend) uploadParts(key string, uploadID string, buf []byte, r io.Reader) (int64, error) {
+	var (
+		total int64
+		parts []s3Part
+		size  = len(buf)
+	)
+	for {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(parts) + 1)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := b.do(http.MethodPut, key, query, nil, buf[:size])
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+		total += int64(size)
+
+		n, eof, err := readPart(r, buf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && eof {
+			break
+		}
+		size = n
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return 0, err
+	}
+	if err := readS3Result(resp); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (b *S3Backend) Get(name string) (int64, io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, b.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return resp.ContentLength, resp.Body, nil
+}
+
+func (b *S3Backend) Has(name string) bool {
+	_, err := b.Stat(name)
+	return err == nil
+}
+
+func (b *S3Backend) Delete(name string) error {
+	resp, err := b.do(http.MethodDelete, b.Prefix+name, nil, nil, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) Stat(name string) (ObjectInfo, error) {
+	resp, err := b.do(http.MethodHead, b.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", name, err)
+	}
+	resp.Body.Close()
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Name: name, Size: resp.ContentLength, Modified: modified}, nil
+}
+
+// List lists objects in lexical order of their names.
+func (b *S3Backend) List(prefix string, fn func(ObjectInfo) error) error {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {b.Prefix + prefix},
+		}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: listing %s: %w", prefix, err)
+		}
+
+		for _, obj := range result.Contents {
+			info := ObjectInfo{
+				Name:     strings.TrimPrefix(obj.Key, b.Prefix),
+				Size:     obj.Size,
+				Modified: obj.LastModified,
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Move copies the object within the bucket and deletes the original, which
+// saves downloading and uploading it again. Objects too large to be copied
+// by the service are moved through this process.
+func (b *S3Backend) Move(from string, to string) error {
+	info, err := b.Stat(from)
+	if err != nil {
+		return err
+	}
+	if info.Size > s3MaxCopySize {
+		return copyObject(b, from, to)
+	}
+
+	header := http.Header{"X-Amz-Copy-Source": {"/" + s3Escape(b.Bucket, false) + "/" + s3Escape(b.Prefix+from, false)}}
+	resp, err := b.do(http.MethodPut, b.Prefix+to, nil, header, nil)
+	if err != nil {
+		return fmt.Errorf("%s: %w", from, err)
+	}
+	if err := readS3Result(resp); err != nil {
+		return err
+	}
+	return b.Delete(from)
+}
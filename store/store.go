@@ -2,12 +2,17 @@ package store
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
-
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/jekki/gdss/gcrypto"
 	"github.com/jekki/gdss/log"
@@ -17,11 +22,27 @@ const (
 	defaultRootFolderName = "gdss"
 )
 
-// CASPathTransformFunc generates a content-addressable storage path from a key.
-func CASPathTransformFunc(key string) PathKey {
-	hash := sha1.Sum([]byte(key))
-	hashStr := hex.EncodeToString(hash[:])
+// CASPathTransformFunc spreads keys over directories named after chunks of
+// their SHA-256 digest.
+var CASPathTransformFunc = NewCASPathTransformFunc(sha256.New)
+
+// LegacyCASPathTransformFunc is the SHA-1 based CASPathTransformFunc of
+// earlier releases, see Migrate.
+var LegacyCASPathTransformFunc = NewCASPathTransformFunc(sha1.New)
+
+// NewCASPathTransformFunc returns a PathTransformFunc that spreads keys over
+// directories named after chunks of their digest under h.
+func NewCASPathTransformFunc(h func() hash.Hash) PathTransformFunc {
+	return func(key string) PathKey {
+		hash := h()
+		hash.Write([]byte(key))
+		return digestPathKey(hex.EncodeToString(hash.Sum(nil)))
+	}
+}
 
+// digestPathKey spreads a hex digest over directories named after chunks of
+// it.
+func digestPathKey(hashStr string) PathKey {
 	blockszie := 5
 	sliceLen := len(hashStr) / blockszie
 	paths := make([]string, sliceLen)
@@ -59,14 +80,34 @@ func (p PathKey) FullPath() string {
 // StoreOpts holds configuration options for the Store.
 type StoreOpts struct {
 	// Root is the folder name of the root, containing all the folders/files of the system.
+	// It holds the metadata index and, unless another Backend is set, the
+	// stored files. Without a Root the index is only kept in memory.
 	Root              string
 	PathTransformFunc PathTransformFunc
 	ID                string
+	// ContentAddressed stores file contents once per distinct digest, with
+	// the path of a key only holding the digest of its contents. Identical
+	// files are deduplicated and Read verifies contents against their
+	// digest. A blob is removed along with the last key referring to it.
+	ContentAddressed bool
+	// Backend holds the stored files. It defaults to a DiskBackend in Root.
+	Backend Backend
 }
 
 // Store manages file storage operations.
 type Store struct {
 	StoreOpts
+
+	layoutOnce sync.Once
+
+	// refLock serialises making keys refer to blobs and chunks with
+	// dropping those references, so nothing is removed while a key is
+	// about to refer to it.
+	refLock sync.Mutex
+
+	indexOnce sync.Once
+	index     *index
+	indexErr  error
 }
 
 // DefaultPathTransformFunc returns the key as the storage path.
@@ -83,29 +124,75 @@ func NewStore(opts StoreOpts) *Store {
 		opts.PathTransformFunc = DefaultPathTransformFunc
 	}
 
-	if len(opts.Root) == 0 {
+	if len(opts.Root) == 0 && opts.Backend == nil {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.Backend == nil {
+		opts.Backend = NewDiskBackend(opts.Root)
+	}
 	return &Store{
 		StoreOpts: opts,
 	}
 }
 
+// objectName returns the name of the backend object holding key.
+func (s *Store) objectName(id string, key string) string {
+	return id + "/" + s.PathTransformFunc(key).FullPath()
+}
+
+// splitObjectName is the inverse of objectName, returning the owner and the
+// path of the object. Objects that hold no file, like blobs, are reported
+// as not ok.
+func splitObjectName(name string) (id string, path string, ok bool) {
+	id, path, ok = strings.Cut(name, "/")
+	if !ok || id == blobsDirName || id == chunksDirName {
+		return "", "", false
+	}
+	return id, path, true
+}
+
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	if s.index != nil && s.index.file != nil {
+		s.index.file.Close()
+	}
+	s.index, s.indexErr, s.indexOnce = nil, nil, sync.Once{}
+	s.layoutOnce = sync.Once{}
+
+	var names []string
+	err := s.Backend.List("", func(obj ObjectInfo) error {
+		names = append(names, obj.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.Backend.Delete(name); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Root) == 0 {
+		return nil
+	}
+	if _, ok := s.Backend.(*DiskBackend); ok {
+		return os.RemoveAll(s.Root)
+	}
+	// Other backends may keep their data in the root, only remove what
+	// the store put there.
+	for _, name := range []string{indexFileName, layoutFileName} {
+		if err := os.Remove(filepath.Join(s.Root, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	_, err := os.Stat(fullPathWithRoot)
-	if err == nil {
-		return true
+	if s.ContentAddressed {
+		return s.hasContent(id, key)
 	}
-	if os.IsNotExist(err) {
-		return false
-	}
-	return false
+	return s.Backend.Has(s.objectName(id, key))
 }
 
 func (s *Store) Delete(id string, key string) error {
@@ -116,9 +203,27 @@ func (s *Store) Delete(id string, key string) error {
 		logger.Infof("deleted [%s] form disk", pathKey.Filename)
 	}()
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	var digest string
+	if s.ContentAddressed {
+		digest, _ = s.digestOf(id, key)
+	}
+	fi, _ := s.Stat(id, key)
+
+	if err := s.Backend.Delete(s.objectName(id, key)); err != nil {
+		return err
+	}
+	if err := s.recordDelete(id, key); err != nil {
+		return err
+	}
+	if len(digest) > 0 {
+		if err := s.removeBlobIfUnused(digest); err != nil {
+			return err
+		}
+	}
+	return s.removeChunks(fi.Chunks)
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
@@ -126,50 +231,141 @@ func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	file, err := os.Open(fullPathWithRoot)
-	if err != nil {
-		return 0, nil, err
-	}
-
-	fi, err := file.Stat()
-	if err != nil {
-		return 0, nil, err
+	if s.ContentAddressed {
+		return s.readContent(id, key)
 	}
-
-	return fi.Size(), file, nil
+	return s.Backend.Get(s.objectName(id, key))
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	n, err := gcrypto.CopyDecrypt(encKey, r, f)
-	return int64(n), err
+// WriteVerified is Write for callers that know what r should yield: the
+// file is only stored if exactly size bytes with the hex encoded SHA-256
+// digest are read, and ErrMismatch is returned otherwise. A negative size
+// or an empty digest is not checked.
+func (s *Store) WriteVerified(id string, key string, r io.Reader, size int64, digest string) (int64, error) {
+	return s.write(id, key, size, digest, nil, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+// WriteDecrypt decrypts r with a key from ring into the file for key. A
+// stream that fails authentication leaves no file behind, so it is never
+// served later.
+func (s *Store) WriteDecrypt(ring gcrypto.KeyRing, id string, key string, r io.Reader) (int64, error) {
+	return s.write(id, key, -1, "", nil, func(w io.Writer) (int64, error) {
+		n, err := gcrypto.CopyDecryptKeyRing(ring, r, w)
+		return int64(n), err
+	})
+}
+
+// RewriteEnvelope lets fn modify the envelope of the encrypted file for key
+// and writes it back in front of the unchanged encrypted body.
+func (s *Store) RewriteEnvelope(id string, key string, fn func(*gcrypto.Envelope) error) error {
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
 	}
+	defer r.Close()
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	e, err := gcrypto.ReadEnvelope(r)
+	if err != nil {
+		return err
+	}
+	if err := fn(e); err != nil {
+		return err
+	}
 
-	return os.Create(fullPathWithRoot)
+	// Read the body to the end before it is replaced.
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// The envelope is all that changes, the file keeps its chunks.
+	fi, _ := s.Stat(id, key)
+	_, err = s.write(id, key, -1, "", fi.Chunks, func(w io.Writer) (int64, error) {
+		n, err := w.Write(e.Marshal())
+		if err != nil {
+			return int64(n), err
+		}
+		nn, err := w.Write(body)
+		return int64(n + nn), err
+	})
+	return err
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return s.write(id, key, -1, "", nil, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// write stores what fill produces under key. The file only appears once it
+// is complete and matches the expected size and digest, a failed or
+// interrupted write leaves the previous contents, if any, in place. chunks
+// are the chunks the file refers to, if it is a manifest.
+func (s *Store) write(id string, key string, size int64, digest string, chunks []string, fill func(w io.Writer) (int64, error)) (int64, error) {
+	s.ensureLayout()
+
+	if s.ContentAddressed {
+		return s.writeContent(id, key, size, digest, chunks, fill)
+	}
+
+	if len(chunks) == 0 {
+		n, sum, err := s.put(s.objectName(id, key), size, digest, fill)
+		if err != nil {
+			return 0, err
+		}
+		s.refLock.Lock()
+		defer s.refLock.Unlock()
+		return n, s.recordWrite(id, key, n, sum, nil)
+	}
+
+	// Manifests are written in place, so their chunks are held on to from
+	// before the manifest replaces the previous file until the index
+	// records it.
+	s.refLock.Lock()
+	defer s.refLock.Unlock()
+	if err := s.checkChunks(key, chunks); err != nil {
+		return 0, err
+	}
+	n, sum, err := s.put(s.objectName(id, key), size, digest, fill)
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	return n, s.recordWrite(id, key, n, sum, chunks)
+}
+
+// put stores what fill produces as the object name. The backend only sees
+// the end of the data once fill succeeded and its output matched size and
+// digest (see verify), so the object is never replaced otherwise. It
+// returns the size and hex encoded SHA-256 digest of the object.
+func (s *Store) put(name string, size int64, digest string, fill func(w io.Writer) (int64, error)) (int64, string, error) {
+	pr, pw := io.Pipe()
+	h := sha256.New()
+
+	var (
+		n    int64
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		var err error
+		n, err = fill(io.MultiWriter(pw, h))
+		if err == nil {
+			err = verify(n, hex.EncodeToString(h.Sum(nil)), size, digest)
+		}
+		pw.CloseWithError(err)
+	}()
+
+	_, err := s.Backend.Put(name, pr)
+	// Unblock fill if the backend gave up early.
+	pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
 }
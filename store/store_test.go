@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jekki/gdss/gcrypto"
@@ -13,8 +15,8 @@ func TestPathTransformFunc(t *testing.T) {
 	// Test the default path transform function
 	key := "store_dir"
 	pathKey := CASPathTransformFunc(key)
-	expectOriginalKey := "c67780c83e93dd5f9964398bd97de9c296f923cb"
-	expectPathName := "c6778/0c83e/93dd5/f9964/398bd/97de9/c296f/923cb"
+	expectOriginalKey := "73639b0502f28b536596b24f1c614a1b6b335d39f4015bc5a877960a2e7c23bf"
+	expectPathName := "73639/b0502/f28b5/36596/b24f1/c614a/1b6b3/35d39/f4015/bc5a8/77960/a2e7c"
 	if pathKey.PathName != expectPathName {
 		t.Errorf("pathname:%s , %s", pathKey.PathName, expectPathName)
 	}
@@ -41,12 +43,58 @@ func TestStoreDeleteKey(t *testing.T) {
 	}
 }
 
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+
+	// Both keys hash to digests starting with d2997, so they share the
+	// first directory level.
+	target, neighbour := "key_661", "key_1157"
+	if CASPathTransformFunc(target).FirstPathName() != CASPathTransformFunc(neighbour).FirstPathName() {
+		t.Fatal("expected keys to share their first directory")
+	}
+	for _, key := range []string{target, neighbour} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id, target); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, target) {
+		t.Errorf("expected to NOT have key %s", target)
+	}
+	if !s.Has(id, neighbour) {
+		t.Errorf("expected neighbouring key %s to survive", neighbour)
+	}
+	if _, err := s.Stat(id, neighbour); err != nil {
+		t.Errorf("expected metadata of %s to survive: %v", neighbour, err)
+	}
+
+	// Only the directories the target had to itself are pruned.
+	targetPath := CASPathTransformFunc(target)
+	if _, err := os.Stat(filepath.Join(s.Root, id, targetPath.PathName)); !os.IsNotExist(err) {
+		t.Errorf("expected empty directories of %s to be pruned", target)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id, targetPath.FirstPathName())); err != nil {
+		t.Errorf("expected shared directory to be kept: %v", err)
+	}
+
+	if err := s.Delete(id, neighbour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id)); !os.IsNotExist(err) {
+		t.Errorf("expected all directories to be pruned")
+	}
+}
+
 func TestStore(t *testing.T) {
 	s := newStore()
 	defer teardown(t, s)
 	id := gcrypto.GenerateID()
 
-	for i := 0; i < 5000; i++ {
+	for i := 0; i < 2000; i++ {
 		key := fmt.Sprintf("food_%d", i)
 
 		data := []byte("test data")
@@ -77,9 +125,77 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestMigrate(t *testing.T) {
+	legacy := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: LegacyCASPathTransformFunc,
+	})
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+	for _, key := range []string{"known", "unknown"} {
+		if _, err := legacy.writeStream(id, key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Roots of earlier releases have no LAYOUT file.
+	if err := os.Remove(filepath.Join(legacy.Root, layoutFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(StoreOpts{
+		Root:              legacy.Root,
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if v, err := s.LayoutVersion(); err != nil || v != LayoutLegacy {
+		t.Fatalf("layout version: %d, %v", v, err)
+	}
+
+	migrated, remaining, err := s.Migrate(LegacyCASPathTransformFunc, map[string]string{"known": "renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 || remaining != 1 {
+		t.Errorf("migrated %d, remaining %d", migrated, remaining)
+	}
+	if v, err := s.LayoutVersion(); err != nil || v != CurrentLayout {
+		t.Errorf("layout version: %d, %v", v, err)
+	}
+
+	_, r, err := s.Read(id, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != string(data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+	if legacy.Has(id, "known") {
+		t.Errorf("expected legacy file of key known to be moved")
+	}
+	if !legacy.Has(id, "unknown") {
+		t.Errorf("expected legacy file of key unknown to be kept")
+	}
+}
+
+func TestLayoutVersionNewRoot(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	if _, err := s.writeStream(gcrypto.GenerateID(), "key", bytes.NewReader([]byte("test data"))); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.LayoutVersion(); err != nil || v != CurrentLayout {
+		t.Errorf("layout version: %d, %v", v, err)
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
+		Root:              defaultRootFolderName,
 		PathTransformFunc: CASPathTransformFunc,
+		// The fixtures need not survive a crash.
+		Backend: &DiskBackend{Root: defaultRootFolderName, NoSync: true},
 	}
 	return NewStore(opts)
 }
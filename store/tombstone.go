@@ -0,0 +1,78 @@
+package store
+
+import (
+	"time"
+)
+
+// Tombstone records that the file stored under a key was deleted, so that
+// replicas which missed the deletion do not bring it back.
+type Tombstone struct {
+	ID      string
+	Key     string
+	Path    string
+	Deleted time.Time
+}
+
+// Bury deletes the file stored under key as of at and leaves a tombstone in
+// its place. A file written after at is newer than the deletion and is
+// kept, as is a tombstone of a later deletion.
+func (s *Store) Bury(id string, key string, at time.Time) error {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return err
+	}
+
+	path := s.PathTransformFunc(key).FullPath()
+	if t, ok := idx.tombstone(id, path); ok && !at.After(t.Deleted) {
+		return nil
+	}
+	if fi, ok := idx.get(id, path); ok && fi.Created.After(at) {
+		return nil
+	}
+
+	if err := s.Delete(id, key); err != nil {
+		return err
+	}
+	return idx.bury(Tombstone{ID: id, Key: key, Path: path, Deleted: at.UTC()})
+}
+
+// Tombstone returns the tombstone left by the deletion of key, if any.
+// Writing key again removes it.
+func (s *Store) Tombstone(id string, key string) (Tombstone, bool) {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return Tombstone{}, false
+	}
+	return idx.tombstone(id, s.PathTransformFunc(key).FullPath())
+}
+
+// Tombstones returns the tombstones of node id, or of every node if id is
+// empty.
+func (s *Store) Tombstones(id string) ([]Tombstone, error) {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	var tombstones []Tombstone
+	for _, t := range idx.tombstones {
+		if len(id) == 0 || t.ID == id {
+			tombstones = append(tombstones, t)
+		}
+	}
+	return tombstones, nil
+}
+
+// CollectTombstones removes the tombstones of deletions that happened more
+// than grace ago and returns how many were removed. Replicas that stay
+// offline longer than grace may bring deleted files back.
+func (s *Store) CollectTombstones(grace time.Duration) (int, error) {
+	idx, err := s.openedIndex()
+	if err != nil {
+		return 0, err
+	}
+	return idx.collect(time.Now().Add(-grace))
+}
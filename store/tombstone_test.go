@@ -0,0 +1,67 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jekki/gdss/gcrypto"
+)
+
+func TestBury(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	id := gcrypto.GenerateID()
+	data := []byte("test data")
+
+	if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A deletion issued before the file was written does not touch it.
+	if err := s.Bury(id, "key", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, "key") {
+		t.Fatal("expected file written after the deletion to be kept")
+	}
+
+	deleted := time.Now()
+	if err := s.Bury(id, "key", deleted); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "key") {
+		t.Errorf("expected to NOT have key %s", "key")
+	}
+
+	// Tombstones outlive the store.
+	s = NewStore(StoreOpts{Root: root, PathTransformFunc: CASPathTransformFunc})
+	ts, ok := s.Tombstone(id, "key")
+	if !ok || !ts.Deleted.Equal(deleted) {
+		t.Errorf("tombstone: %+v, %v", ts, ok)
+	}
+	if all, err := s.Tombstones(id); err != nil || len(all) != 1 {
+		t.Errorf("tombstones: %v, %v", all, err)
+	}
+
+	if n, err := s.CollectTombstones(time.Hour); err != nil || n != 0 {
+		t.Errorf("collected %d tombstones within the grace period: %v", n, err)
+	}
+	if n, err := s.CollectTombstones(0); err != nil || n != 1 {
+		t.Errorf("collected %d tombstones: %v", n, err)
+	}
+	if _, ok := s.Tombstone(id, "key"); ok {
+		t.Errorf("expected tombstone to be collected")
+	}
+
+	// Writing the key again removes its tombstone.
+	if err := s.Bury(id, "key", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(id, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Tombstone(id, "key"); ok {
+		t.Errorf("expected tombstone to be removed by the write")
+	}
+}